@@ -0,0 +1,1327 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Mark of daemon process - system environment variable _GO_DAEMON=1
+const (
+	MARK_NAME  = "_GO_DAEMON"
+	MARK_VALUE = "1"
+)
+
+// Default file permissions for log and pid files.
+const FILE_PERM = os.FileMode(0640)
+
+// Default time Restart waits for the old daemon to exit.
+const RESTART_TIMEOUT = 10 * time.Second
+
+var (
+	// ErrNotRunning indicates that the daemon is not running.
+	ErrNotRunning = errors.New("daemon is not running")
+	// ErrAlreadyRunning indicates that the daemon is already running.
+	ErrAlreadyRunning = errors.New("daemon is already running")
+	// ErrStalePidFile indicates that the pid file exists, but does not refer
+	// to the running daemon. It wraps ErrNotRunning.
+	ErrStalePidFile = fmt.Errorf("%w: stale pid file", ErrNotRunning)
+	// ErrNoPidFile indicates that there is no pid file, so the daemon is not
+	// running. It wraps ErrNotRunning.
+	ErrNoPidFile = fmt.Errorf("%w: no pid file", ErrNotRunning)
+	// ErrProcessGone indicates that the process of pid file does not exist,
+	// e.g. the daemon crashed. It wraps ErrStalePidFile.
+	ErrProcessGone = fmt.Errorf("%w: process is gone", ErrStalePidFile)
+	// ErrOtherHost indicates that the pid file is written by another host,
+	// see PidFileHost.
+	ErrOtherHost = errors.New("pid file is written by another host")
+	// ErrStopTimeout indicates that the daemon did not exit in time.
+	ErrStopTimeout = errors.New("timeout waiting for daemon to stop")
+	// ErrNotReady indicates that the daemon exited before it was ready.
+	ErrNotReady = errors.New("daemon exited before it was ready")
+	// ErrReadyTimeout indicates that the daemon did not get ready in time.
+	ErrReadyTimeout = errors.New("timeout waiting for daemon to be ready")
+	// ErrSetsid indicates that the kernel refused to start a new session
+	// for the daemon-process, e.g. since it is a process group leader.
+	// NoSetsid avoids it.
+	ErrSetsid = errors.New("daemon failed to start a new session")
+	// ErrPidFileOwner indicates that the existing pid file is owned by
+	// another user, e.g. it belongs to the daemon of another user.
+	ErrPidFileOwner = errors.New("pid file is owned by another user")
+)
+
+// errLogWriter indicates conflicting options of daemon output.
+var errLogWriter = errors.New("LogWriter excludes LogFileName, StderrFileName and UseSyslog")
+
+// errKeepStdStreams indicates conflicting options of daemon output.
+var errKeepStdStreams = errors.New("KeepStdStreams excludes LogFileName, StderrFileName, UseSyslog and LogWriter")
+
+// errLogFileFlag indicates LogFileFlag, which does not open files for writing.
+var errLogFileFlag = errors.New("LogFileFlag requires O_WRONLY or O_RDWR")
+
+// Reborn runs second copy of current process in the given context.
+// function executes separate parts of code in child process and parent process
+// and provides demonization of child process. It look similar as the
+// fork-daemonization, but goroutine-safe.
+// In success returns *os.Process in parent process and nil in child process.
+// Otherwise returns error.
+// Usually the parent process exits at once. A parent, which keeps running,
+// should call Wait, otherwise the exited daemon-process remains a zombie,
+// or set DoubleFork. It may reuse the context to start the daemon again,
+// e.g. after it has exited, the files and pipes are opened anew by each call.
+// With QueueSignals the daemon-process queues SIGHUP from Reborn on, until
+// it calls Context.ServeSignals.
+func (d *Context) Reborn() (child *os.Process, err error) {
+	return d.RebornContext(context.Background())
+}
+
+// RebornContext is like Reborn, but parent process gives up once ctx is done
+// before the daemon-process has read the context: the daemon-process is
+// killed, the pid file is released and ctx.Err() is returned.
+// The context may be taken as read once it is written into the pipe
+// to the daemon-process. In child process ctx is not used.
+func (d *Context) RebornContext(ctx context.Context) (child *os.Process, err error) {
+	if !d.WasReborn() {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		if child, err = d.parent(ctx); err == nil && d.OnFork != nil {
+			err = d.OnFork(child)
+		}
+		if err != nil {
+			d.logger().Errorf("start daemon-process: %v", err)
+		}
+	} else if err = d.child(); err == nil {
+		daemonReady = true
+		if d.QueueSignals {
+			queueSignals()
+		}
+		d.logger().Debugf("daemon-process is initialized")
+	} else {
+		d.logger().Errorf("initialize daemon-process: %v", err)
+	}
+	return
+}
+
+// sendConfig writes conf encoded to JSON into the pipe to the daemon-process.
+// The encoded context may exceed the pipe buffer, e.g. with large Env, so
+// the write blocks until the daemon-process reads the rest. If ctx is done
+// before, the daemon-process is killed and ctx.Err() is returned. The pending
+// write is interrupted by closeFiles.
+func (d *Context) sendConfig(ctx context.Context, child *os.Process, conf interface{}) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- json.NewEncoder(d.wpipe).Encode(conf)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		child.Kill()
+		// reap the child, it fails with DoubleFork
+		child.Wait()
+		return ctx.Err()
+	}
+}
+
+// Validate checks the context in parent process before Reborn: conflicting
+// options, pid and log files can be opened or created, Chroot and WorkDir
+// are directories, ExecPath is executable, the user and group of Credential
+// exist. Nothing is started, created or locked.
+func (d *Context) Validate() (err error) {
+	if err = d.checkOptions(); err != nil {
+		return
+	}
+	if len(d.PidFileName) > 0 {
+		if err = checkPidFileOwner(d.PidFileName, d.pidFileOwners()...); err != nil {
+			return
+		}
+		if err = checkFile(d.PidFileName, os.O_RDWR); err != nil {
+			return
+		}
+	}
+	for _, name := range []string{d.LogFileName, d.StderrFileName} {
+		if len(name) > 0 {
+			if err = checkFile(name, os.O_WRONLY|os.O_APPEND); err != nil {
+				return
+			}
+		}
+	}
+	if len(d.Chroot) > 0 {
+		if err = checkDir(d.Chroot); err != nil {
+			return
+		}
+	}
+	if len(d.WorkDir) > 0 {
+		if err = checkDir(filepath.Join(d.Chroot, d.WorkDir)); err != nil {
+			return
+		}
+	}
+	if len(d.ExecPath) > 0 {
+		if _, err = lookExec(d.ExecPath); err != nil {
+			return
+		}
+	}
+	return d.checkCredential()
+}
+
+// checkFile reports whether the named file can be opened with given flags.
+// The file, which does not exist, is not created, its directory must be
+// writable then.
+func checkFile(name string, flag int) error {
+	file, err := os.OpenFile(name, flag, 0)
+	if err == nil {
+		return file.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if err = checkDir(dir); err != nil {
+		return err
+	}
+	return checkWritable(dir)
+}
+
+// checkDir reports whether the named file is a directory.
+func checkDir(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return &os.PathError{Op: "stat", Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// Search search daemons process by given in context pid file name.
+// If success returns pointer on daemons os.Process structure,
+// else returns error. Returns nil if filename is empty.
+func (d *Context) Search() (daemon *os.Process, err error) {
+	if len(d.PidFileName) > 0 {
+		var pid int
+		if pid, err = ReadPidFile(d.PidFileName); err != nil {
+			return
+		}
+		daemon, err = os.FindProcess(pid)
+	}
+	return
+}
+
+// SearchByExe searches the daemon by its executable, e.g. if the daemon runs
+// without pid file. The daemon is a process, except the current one, which
+// runs ExecName or the executable of the current process, see
+// IsProcessRunningAs, and has the mark of the daemon-process in environment,
+// if the environment can be read. Of several such processes the oldest is
+// returned, e.g. the supervisor rather than its worker, see Supervise.
+// Returns ErrNotRunning if there is no such process.
+// It is supported on Linux only.
+func (d *Context) SearchByExe() (daemon *os.Process, err error) {
+	exe := d.ExecName
+	if len(exe) == 0 {
+		if exe, err = GetExecPath(os.Getpid()); err != nil {
+			return
+		}
+	}
+	var pids []int
+	if pids, err = findExec(exe); err != nil {
+		return
+	}
+	name, value := d.mark()
+	mark := name + "=" + value
+
+	found := 0
+	var oldest time.Time
+	for _, pid := range pids {
+		if env, e := processEnv(pid); e == nil && !hasEnv(env, mark) {
+			continue
+		}
+		start, e := processStartTime(pid)
+		if found == 0 || (e == nil && start.Before(oldest)) {
+			found, oldest = pid, start
+		}
+	}
+	if found == 0 {
+		return nil, ErrNotRunning
+	}
+	return os.FindProcess(found)
+}
+
+// FindDaemons returns the processes, except the current one, which run
+// the executable exe, given either by path or by base name, e.g. all
+// instances of the program with different pid files. The executable
+// matches also after its file is deleted or replaced. Processes, whose
+// executable can not be read, e.g. of other users, are skipped.
+// It is supported on Linux only.
+func FindDaemons(exe string) (daemons []*os.Process, err error) {
+	var pids []int
+	if pids, err = findExec(exe); err != nil {
+		return
+	}
+	for _, pid := range pids {
+		var p *os.Process
+		if p, err = os.FindProcess(pid); err != nil {
+			return nil, err
+		}
+		daemons = append(daemons, p)
+	}
+	return
+}
+
+// findExec returns pids of the processes, except the current one, which run
+// the executable exe.
+func findExec(exe string) (pids []int, err error) {
+	var all []int
+	if all, err = listPids(); err != nil {
+		return
+	}
+	for _, pid := range all {
+		if pid == os.Getpid() {
+			continue
+		}
+		if path, e := GetExecPath(pid); e == nil && matchExec(path, exe) {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
+
+// hasEnv reports whether env holds the variable kv in form "name=value".
+func hasEnv(env []string, kv string) bool {
+	for _, v := range env {
+		if v == kv {
+			return true
+		}
+	}
+	return false
+}
+
+// pidFileInfo returns the info written into pid file after the pid.
+func (d *Context) pidFileInfo() (info map[string]string, err error) {
+	if !d.PidFileHost {
+		return d.PidFileInfo, nil
+	}
+	info = map[string]string{}
+	for key, value := range d.PidFileInfo {
+		info[key] = value
+	}
+	info[pidHostKey], err = os.Hostname()
+	return
+}
+
+// checkHost returns error wrapping ErrOtherHost, if the pid file is written
+// by another host.
+func (d *Context) checkHost() error {
+	host, err := ReadPidHost(d.PidFileName)
+	if err != nil || len(host) == 0 {
+		return nil
+	}
+	if name, err := os.Hostname(); err == nil && name != host {
+		return fmt.Errorf("%w %s", ErrOtherHost, host)
+	}
+	return nil
+}
+
+// ChildPid returns the id of the daemon-process started by the last
+// successful Reborn in parent process. Returns 0 before Reborn and
+// in child process.
+func (d *Context) ChildPid() int {
+	return d.childPid
+}
+
+// Uptime returns how long the running daemon has been alive. It is
+// computed from the start time of the process or, if it is not available,
+// from modification time of pid file. Returns the same errors as StopE,
+// if the daemon is not running.
+func (d *Context) Uptime() (time.Duration, error) {
+	p, err := d.getRunningProcess()
+	if err != nil {
+		return 0, err
+	}
+	start, err := processStartTime(p.Pid)
+	if err != nil {
+		var fi os.FileInfo
+		if fi, err = os.Stat(d.PidFileName); err != nil {
+			return 0, err
+		}
+		start = fi.ModTime()
+	}
+	return time.Since(start), nil
+}
+
+// Wait waits for the daemon-process started by the last successful Reborn
+// to exit and returns its state. The pid file left by the daemon-process,
+// e.g. failed to initialize, is removed. With LogWriter, Wait returns once
+// the output is copied, i.e. the processes holding the pipe have exited.
+// The syslog forwarder of UseSyslog is reaped as well. It fails if DoubleFork
+// is set, since the daemon-process is not a child then.
+func (d *Context) Wait() (state *os.ProcessState, err error) {
+	if d.childPid == 0 {
+		return nil, ErrNotRunning
+	}
+	var p *os.Process
+	if p, err = os.FindProcess(d.childPid); err != nil {
+		return
+	}
+	if state, err = p.Wait(); err == nil {
+		d.removeStalePidFile(d.childPid)
+		if d.logDone != nil {
+			<-d.logDone
+		}
+		d.reapForwarder()
+	}
+	return
+}
+
+// removeStalePidFile removes the pid file, if it is not locked and refers
+// to the exited daemon-process with given pid, e.g. failed to initialize.
+func (d *Context) removeStalePidFile(pid int) {
+	if len(d.PidFileName) == 0 {
+		return
+	}
+	if d.LockDir {
+		// the lock directory holds the pid of parent, if the daemon-process
+		// has failed before writing its own one
+		lock := NewDirLock(d.lockDirName())
+		if owner, err := lock.Owner(); err == nil && (owner == pid || owner == os.Getpid()) {
+			os.Remove(d.PidFileName)
+			lock.Unlock()
+		}
+		return
+	}
+	file, err := os.OpenFile(d.PidFileName, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	lock := NewLockFile(file)
+	if err = lock.Lock(); err != nil {
+		lock.Close()
+		return
+	}
+	if p, err := lock.ReadPid(); err == nil && p == pid {
+		lock.Remove()
+		return
+	}
+	lock.Unlock()
+	lock.Close()
+}
+
+// WasReborn returns true in child process (daemon) and false in parent process.
+// It checks the default mark, see Context.WasReborn.
+func WasReborn() bool {
+	return os.Getenv(MARK_NAME) == MARK_VALUE
+}
+
+// WasReborn returns true in child process (daemon) and false in parent process
+// according to the mark of the context.
+func (d *Context) WasReborn() bool {
+	name, value := d.mark()
+	return os.Getenv(name) == value
+}
+
+// mark returns name and value of the environment variable, which marks
+// the daemon-process.
+func (d *Context) mark() (name, value string) {
+	name, value = d.MarkName, d.MarkValue
+	if len(name) == 0 {
+		name = MARK_NAME
+	}
+	if len(value) == 0 {
+		value = MARK_VALUE
+	}
+	return
+}
+
+var initialized = false
+
+// errIncompleteContext indicates that the context received by the
+// daemon-process lacks the fields, which parent process always sets.
+var errIncompleteContext = errors.New("incomplete context of parent")
+
+// check validates the context received by the daemon-process.
+func (d *Context) check() error {
+	if len(d.Args) == 0 || len(d.Env) == 0 {
+		return errIncompleteContext
+	}
+	return nil
+}
+
+// daemonReady is set once the daemon-process is initialized by Reborn.
+var daemonReady = false
+
+// replacing is set in the new copy of the daemon-process started by ReExec
+// until it calls NotifyReady.
+var replacing = false
+
+// IsDaemonReady returns true in the daemon-process once Reborn has
+// initialized it successfully. Unlike WasReborn, which only checks
+// the mark in environment, it reports that descriptors, pid file
+// and the other options of context are set up.
+func IsDaemonReady() bool {
+	return daemonReady
+}
+
+func (d *Context) prepareEnv() (err error) {
+	// get the correct exec path even if process executed through symlink
+	if len(d.ExecPath) > 0 {
+		d.abspath, err = lookExec(d.ExecPath)
+	} else if d.abspath, err = GetExecPath(os.Getpid()); err == ErrNoProc {
+		// the program is run by the path or found in PATH
+		d.abspath, err = lookExec(os.Args[0])
+	}
+	if err != nil {
+		return
+	}
+
+	// the daemon-process changes its working directory, so the names are
+	// resolved by parent once
+	for _, name := range []*string{&d.PidFileName, &d.LogFileName, &d.StderrFileName} {
+		if len(*name) > 0 {
+			if *name, err = filepath.Abs(*name); err != nil {
+				return
+			}
+		}
+	}
+
+	if len(d.Args) == 0 {
+		d.Args = withoutArg(os.Args, d.Subcommand)
+	}
+
+	name, value := d.mark()
+	mark := fmt.Sprintf("%s=%s", name, value)
+	if len(d.Env) == 0 {
+		d.Env = os.Environ()
+	}
+	if d.EnvFilter != nil {
+		d.Env = filterEnv(d.Env, d.EnvFilter)
+	}
+	// the context may be reused, e.g. to restart the daemon
+	if !hasEnv(d.Env, mark) {
+		d.Env = append(d.Env, mark)
+	}
+
+	return
+}
+
+// filterEnv returns the variables of env, for which filter returns true.
+func filterEnv(env []string, filter func(key, value string) bool) (filtered []string) {
+	for _, kv := range env {
+		key, value := kv, ""
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			key, value = kv[:i], kv[i+1:]
+		}
+		if filter(key, value) {
+			filtered = append(filtered, kv)
+		}
+	}
+	return
+}
+
+// withoutArg returns args without the first occurrence of arg after
+// the program name. Args are returned as is, if arg is empty.
+func withoutArg(args []string, arg string) []string {
+	if len(arg) == 0 {
+		return args
+	}
+	for i := 1; i < len(args); i++ {
+		if args[i] == arg {
+			return append(args[:i:i], args[i+1:]...)
+		}
+	}
+	return args
+}
+
+// lookExec returns the absolute path of the named executable, which is
+// searched in PATH, if the name has no path separators.
+func lookExec(name string) (path string, err error) {
+	if path, err = exec.LookPath(name); err != nil {
+		return
+	}
+	return filepath.Abs(path)
+}
+
+// Flags of opening log files, if LogFileFlag is zero.
+const logFileFlag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+
+// validLogFileFlag reports whether flag opens log files for writing.
+func validLogFileFlag(flag int) bool {
+	return flag == 0 || flag&(os.O_WRONLY|os.O_RDWR) != 0
+}
+
+// openLogFile opens the named log file with LogFileFlag and given perm.
+func (d *Context) openLogFile(name string, perm os.FileMode) (*os.File, error) {
+	flag := d.LogFileFlag
+	if flag == 0 {
+		flag = logFileFlag
+	}
+	return os.OpenFile(name, flag, filePerm(perm))
+}
+
+// filePerm returns perm of a new file, or FILE_PERM if perm is zero.
+// The default is not stored in the context, which may be reused.
+func filePerm(perm os.FileMode) os.FileMode {
+	if perm == 0 {
+		return FILE_PERM
+	}
+	return perm
+}
+
+// startLogWriter creates the pipe for stdout and stderr of the daemon-process
+// and starts copying from it into LogWriter. Returns the write end.
+func (d *Context) startLogWriter() (w *os.File, err error) {
+	var r *os.File
+	if r, w, err = os.Pipe(); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	d.logDone = done
+	go func(out io.Writer) {
+		defer close(done)
+		defer r.Close()
+		io.Copy(out, r)
+	}(d.LogWriter)
+	return
+}
+
+// stdin returns the file for stdin of the daemon-process.
+func (d *Context) stdin() *os.File {
+	if d.StdinFile != nil {
+		return d.StdinFile
+	} else if d.Foreground {
+		return os.Stdin
+	}
+	return d.nullFile
+}
+
+// stdout returns the file for stdout of the daemon-process.
+func (d *Context) stdout() *os.File {
+	if d.Foreground || d.KeepStdStreams {
+		return os.Stdout
+	} else if d.logFile != nil {
+		return d.logFile
+	}
+	return d.nullFile
+}
+
+// stderr returns the file for stderr of the daemon-process.
+func (d *Context) stderr() *os.File {
+	if d.Foreground || d.KeepStdStreams {
+		return os.Stderr
+	} else if d.errFile != nil {
+		return d.errFile
+	}
+	return d.stdout()
+}
+
+// LogFile returns the log file in the daemon-process, e.g. to Sync it before
+// exit. It is os.Stdout, so it follows ReopenLog. Returns nil in parent
+// process, in Foreground and if LogFileName is empty, i.e. the output
+// is discarded or sent to syslog.
+func (d *Context) LogFile() *os.File {
+	if !initialized || len(d.LogFileName) == 0 || d.Foreground {
+		return nil
+	}
+	return os.Stdout
+}
+
+// ResolvedPidFile returns the absolute name of pid file, which Reborn
+// creates, or an empty string, if PidFileName is empty. Before Reborn
+// relative PidFileName is resolved against the working directory of
+// the current process, as Reborn does, in the daemon-process it is already
+// absolute, see PidFileName. With Chroot the name is outside of the new root.
+func (d *Context) ResolvedPidFile() string {
+	if len(d.PidFileName) == 0 {
+		return ""
+	}
+	name, err := filepath.Abs(d.PidFileName)
+	if err != nil {
+		return d.PidFileName
+	}
+	return name
+}
+
+// Release provides correct pid-file release in daemon. In parent process
+// it waits for the syslog forwarder of UseSyslog, which exits with
+// the daemon-process, if the daemon-process is not waited for by Wait.
+func (d *Context) Release() (err error) {
+	d.reapForwarder()
+	if !initialized {
+		return
+	}
+	if d.pidFile != nil && replacing {
+		// the lock belongs to the open file, the old daemon-process
+		// waiting in ReExec keeps both
+		err = d.pidFile.Close()
+		d.pidFile = nil
+	} else if d.pidFile != nil {
+		err = d.removePidFile()
+		d.pidFile = nil
+	}
+	if d.dirLock != nil && !replacing {
+		if e := d.dirLock.Unlock(); err == nil {
+			err = e
+		}
+		d.dirLock = nil
+	}
+	return
+}
+
+// State describes the state of the daemon found by pid file.
+type State int
+
+const (
+	// StateStopped means that pid file is absent.
+	StateStopped State = iota
+	// StateRunning means that pid file refers to the running daemon.
+	StateRunning
+	// StateCrashed means that pid file exists, but the daemon is not running.
+	StateCrashed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateRunning:
+		return "running"
+	case StateCrashed:
+		return "crashed"
+	}
+	return "stopped"
+}
+
+// State returns the state of the daemon without printing or exiting.
+// The daemon is crashed if pid file exists, but its pid does not belong
+// to the daemon process. If the pid file is written by another host,
+// the daemon is stopped on this host and the error wraps ErrOtherHost.
+func (d *Context) State() (State, error) {
+	p, err := d.Search()
+	if p == nil {
+		if err != nil && !os.IsNotExist(err) {
+			return StateStopped, err
+		}
+		return StateStopped, nil
+	} else if err = d.checkHost(); err != nil {
+		return StateStopped, err
+	} else if d.isRunning(p.Pid) {
+		return StateRunning, nil
+	}
+	return StateCrashed, nil
+}
+
+// IsRunning reports whether the daemon is running. If it is not, e.g.
+// there is no pid file or the pid file is stale, IsRunning returns false
+// without error. Other errors, e.g. ErrOtherHost, are returned.
+func (d *Context) IsRunning() (bool, error) {
+	p, err := d.getRunningProcess()
+	if errors.Is(err, ErrNotRunning) {
+		return false, nil
+	}
+	return p != nil, err
+}
+
+// MarshalText encodes the state as its name, e.g. in JSON.
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// StatusInfo describes the daemon for machine consumption, e.g. encoded
+// to JSON. Uptime is encoded in nanoseconds.
+type StatusInfo struct {
+	State State `json:"state"`
+	// PID and ExePath describe the running daemon, they are empty otherwise.
+	PID     int           `json:"pid"`
+	Uptime  time.Duration `json:"uptime"`
+	ExePath string        `json:"exe_path"`
+	PidFile string        `json:"pid_file"`
+}
+
+// StatusInfo returns the state of the daemon, see State, and the details
+// of the running daemon without printing or exiting.
+func (d *Context) StatusInfo() (info StatusInfo, err error) {
+	info.PidFile = d.PidFileName
+	if info.State, err = d.State(); err != nil || info.State != StateRunning {
+		return
+	}
+	var p *os.Process
+	if p, err = d.getRunningProcess(); err != nil {
+		// the daemon has just exited
+		info.State, err = d.State()
+		return
+	}
+	info.PID = p.Pid
+	if info.Uptime, err = d.Uptime(); err != nil {
+		return
+	}
+	info.ExePath, err = GetExecPath(p.Pid)
+	return
+}
+
+// ProbeResult tells which checks of Probe the daemon passed.
+type ProbeResult struct {
+	// PID is the pid read from the pid file. PidFile reports that the pid
+	// file exists and holds a pid, the other checks fail otherwise.
+	PID     int  `json:"pid"`
+	PidFile bool `json:"pid_file"`
+	// Locked reports that the pid file is locked, i.e. held by a process,
+	// see ProbePidFile.
+	Locked bool `json:"locked"`
+	// Alive reports that the process with PID exists.
+	Alive bool `json:"alive"`
+	// StartMatch reports that the start time of the process matches the one
+	// written into the pid file. It fails, if either is unknown.
+	StartMatch bool `json:"start_match"`
+	// ExecMatch reports that the process runs the executable of the daemon,
+	// see ExecName.
+	ExecMatch bool `json:"exec_match"`
+}
+
+// Healthy reports whether the daemon is running: the pid file is locked
+// and the process is alive and identified by its start time or executable.
+func (r ProbeResult) Healthy() bool {
+	return r.PidFile && r.Locked && r.Alive && (r.StartMatch || r.ExecMatch)
+}
+
+// Probe checks the daemon by every means at once, unlike State, which stops
+// at the first decisive check, e.g. for monitoring. Missing, empty or
+// stale pid file fails the checks, error is returned only if the pid
+// file can not be read.
+func (d *Context) Probe() (r ProbeResult, err error) {
+	if len(d.PidFileName) == 0 {
+		return
+	}
+	var pid int
+	if pid, r.Locked, err = ProbePidFile(d.PidFileName); os.IsNotExist(err) || errors.Is(err, errInvalidPid) {
+		return r, nil
+	} else if err != nil {
+		return
+	}
+	r.PID, r.PidFile = pid, true
+	if r.Alive = processExists(pid); !r.Alive {
+		return
+	}
+	r.StartMatch, _ = matchStart(pid, d.PidFileName)
+
+	exe := d.ExecName
+	if len(exe) == 0 {
+		if exe, err = GetExecPath(os.Getpid()); err != nil {
+			return
+		}
+	}
+	if path, e := GetExecPath(pid); e == nil {
+		r.ExecMatch = matchExec(path, exe)
+	}
+	return
+}
+
+// StatusE is the same as State.
+func (d *Context) StatusE() (State, error) {
+	return d.State()
+}
+
+// out returns the writer of messages of Start, Stop, Kill and Status.
+func (d *Context) out() io.Writer {
+	if d.Out != nil {
+		return d.Out
+	}
+	return os.Stdout
+}
+
+// Logger receives messages about the lifecycle of the daemon, see
+// Context.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+func (d *Context) logger() Logger {
+	if d.Logger != nil {
+		return d.Logger
+	}
+	return nopLogger{}
+}
+
+// Status prints the state of the daemon and exits, exit code is 0
+// only if the daemon is running. A warning is printed first, if the pid
+// file is written by another host.
+func (d *Context) Status() {
+	state, err := d.State()
+	if errors.Is(err, ErrOtherHost) {
+		fmt.Fprintln(d.out(), "warning:", err)
+	}
+	fmt.Fprintln(d.out(), state)
+	if state == StateRunning {
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+// getRunningProcess returns the running daemon. If it is not running,
+// the error wraps ErrNotRunning: ErrNoPidFile if there is no pid file,
+// ErrProcessGone if the process of pid file does not exist, ErrStalePidFile
+// if the pid file does not refer to the daemon. The errors give the pid
+// found in pid file. Returns ErrOtherHost if the pid file is written
+// by another host.
+func (d *Context) getRunningProcess() (*os.Process, error) {
+	if len(d.PidFileName) == 0 {
+		return nil, ErrNotRunning
+	}
+	pid, err := ReadPidFile(d.PidFileName)
+	if os.IsNotExist(err) {
+		return nil, ErrNoPidFile
+	} else if _, ok := err.(*os.PathError); ok {
+		return nil, err
+	} else if err != nil {
+		// the content is not a pid
+		return nil, fmt.Errorf("%w: %v", ErrStalePidFile, err)
+	}
+	if err = d.checkHost(); err != nil {
+		return nil, err
+	}
+	if !processExists(pid) {
+		return nil, fmt.Errorf("%w: pid %d", ErrProcessGone, pid)
+	} else if !d.isRunning(pid) {
+		return nil, fmt.Errorf("%w: pid %d is another process", ErrStalePidFile, pid)
+	}
+	return os.FindProcess(pid)
+}
+
+// StopE sends StopSignal to the running daemon, waits for it and removes
+// the pid file. If StopTimeout is non-zero and the daemon does not exit
+// in time, it is killed by SIGKILL.
+// If the daemon is not running, the error wraps ErrNotRunning and tells
+// why: ErrNoPidFile if there is no pid file, ErrProcessGone if the process
+// of pid file does not exist, ErrStalePidFile if the pid file refers
+// to another process.
+func (d *Context) StopE() (err error) {
+	return d.StopWithPolicy(StopPolicy{Timeout: d.StopTimeout, Escalate: true})
+}
+
+// StopPolicy describes how StopWithPolicy stops the daemon.
+type StopPolicy struct {
+	// Signal is sent to the daemon, e.g. SIGKILL to stop it at once.
+	// If zero, StopSignal is used.
+	Signal syscall.Signal
+	// If Timeout is non-zero, the daemon is waited for no longer than
+	// Timeout. Otherwise it is waited for unboundedly. The daemon is polled,
+	// since it may be no child of the current process, the child is reaped.
+	Timeout time.Duration
+	// If Escalate is true, the daemon, which does not exit within Timeout,
+	// is killed by SIGKILL and waited for once more. Otherwise
+	// ErrStopTimeout is returned and the daemon keeps running.
+	Escalate bool
+}
+
+// StopWithPolicy sends the signal of policy to the running daemon, waits for
+// it and removes the pid file. StopE and KillE are the usual policies.
+// Returns the same errors as StopE, if the daemon is not running.
+func (d *Context) StopWithPolicy(policy StopPolicy) (err error) {
+	var p *os.Process
+	if p, err = d.getRunningProcess(); err != nil {
+		return
+	}
+	sig := policy.Signal
+	if sig == 0 {
+		sig = d.stopSignal()
+	}
+	d.logger().Debugf("sending %v to daemon %d", sig, p.Pid)
+	if err = sendSignal(p, sig); err != nil {
+		return
+	}
+	// the daemon may be no child of the current process, e.g. if it is
+	// stopped by another invocation of the program, so it is polled, and
+	// the pid file is kept until it exits
+	var deadline time.Time
+	if policy.Timeout > 0 {
+		deadline = time.Now().Add(policy.Timeout)
+	}
+	if !d.waitExit(p, deadline) {
+		if !policy.Escalate {
+			return ErrStopTimeout
+		}
+		d.logger().Debugf("killing daemon %d, which did not exit in %v", p.Pid, policy.Timeout)
+		if err = p.Kill(); err != nil {
+			return
+		}
+		deadline = time.Now().Add(policy.Timeout)
+		if !d.waitExit(p, deadline) {
+			return ErrStopTimeout
+		}
+	}
+	reapChild(p, deadline)
+	os.Remove(d.PidFileName)
+	return
+}
+
+// isRunning reports whether the process with given pid is the daemon-process.
+func (d *Context) isRunning(pid int) bool {
+	if IsProcessRunningAs(pid, d.ExecName, d.PidFileName) {
+		return true
+	}
+	// The binary of the daemon may be replaced since start, e.g. on upgrade,
+	// so the paths of executables differ. The daemon holds the lock of pid
+	// file, it is enough to match the name of executable then.
+	if len(d.ExecName) > 0 || !d.pidFileLocked() {
+		return false
+	}
+	exe, err := GetExecPath(os.Getpid())
+	if err != nil {
+		return false
+	}
+	return IsProcessRunningAs(pid, filepath.Base(exe))
+}
+
+// pidFileLocked reports whether the pid file is locked by another process.
+// With LockDir the lock directory is checked instead.
+func (d *Context) pidFileLocked() bool {
+	if d.LockDir {
+		pid, err := NewDirLock(d.lockDirName()).Owner()
+		return err == nil && pid != os.Getpid() && processExists(pid)
+	}
+	return isFileLocked(d.PidFileName)
+}
+
+// waitExit polls the daemon process until it exits or the deadline
+// is reached, if it is non-zero. Returns false on timeout.
+func (d *Context) waitExit(p *os.Process, deadline time.Time) bool {
+	for d.isRunning(p.Pid) {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
+
+func (d *Context) stopSignal() syscall.Signal {
+	if d.StopSignal == 0 {
+		return syscall.SIGTERM
+	}
+	return d.StopSignal
+}
+
+// Stop is like StopE, but prints the result. Exits on error.
+func (d *Context) Stop() {
+	if err := d.StopE(); errors.Is(err, ErrNotRunning) {
+		fmt.Fprintln(d.out(), "not running")
+		return
+	} else if err != nil {
+		fmt.Fprintln(d.out(), "error:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(d.out(), "stopped")
+}
+
+// KillE sends SIGKILL to the running daemon, waits for it and removes
+// the pid file.
+// Returns the same errors as StopE, if the daemon is not running.
+func (d *Context) KillE() (err error) {
+	return d.StopWithPolicy(StopPolicy{Signal: syscall.SIGKILL})
+}
+
+// Kill is like KillE, but prints the result. Exits on error.
+func (d *Context) Kill() {
+	if err := d.KillE(); errors.Is(err, ErrNotRunning) {
+		fmt.Fprintln(d.out(), "not running")
+		return
+	} else if err != nil {
+		fmt.Fprintln(d.out(), "error:", err)
+		os.Exit(1)
+	}
+	fmt.Fprintln(d.out(), "killed")
+}
+
+// StartE reborns the daemon unless it is already running, in which case
+// ErrAlreadyRunning is returned. The daemon is running also if the pid file
+// is locked, e.g. by the daemon, which is starting, see LockRetries. Stale
+// pid file is removed first. Results are the same as Reborn's.
+func (d *Context) StartE() (p *os.Process, err error) {
+	p, _, err = d.start()
+	return
+}
+
+// start is like StartE, but also reports whether the stale pid file is
+// removed.
+func (d *Context) start() (p *os.Process, removed bool, err error) {
+	if p, err = d.getRunningProcess(); p != nil {
+		return nil, false, ErrAlreadyRunning
+	} else if errors.Is(err, ErrStalePidFile) {
+		removed = d.removeStale()
+	}
+	if p, err = d.Reborn(); err == ErrWouldBlock {
+		return nil, removed, ErrAlreadyRunning
+	}
+	return
+}
+
+// Default interval between attempts to lock the pid file.
+const lockRetryInterval = 100 * time.Millisecond
+
+// lockPidFile locks the open pid file or the lock directory, see LockDir,
+// retrying LockRetries times while it is locked by another instance.
+func (d *Context) lockPidFile() (err error) {
+	interval := d.LockRetryInterval
+	if interval == 0 {
+		interval = lockRetryInterval
+	}
+	if d.LockDir {
+		d.dirLock = NewDirLock(d.lockDirName())
+	}
+	for i := 0; ; i++ {
+		if d.dirLock != nil {
+			err = d.dirLock.TryLock(os.Getpid())
+		} else {
+			err = d.pidFile.TryLock()
+		}
+		if err == nil && d.dirLock != nil {
+			d.logger().Debugf("locked directory %s", d.dirLock.Name)
+		} else if err == nil {
+			d.logger().Debugf("locked pid file %s", d.PidFileName)
+		}
+		if err != ErrWouldBlock || i >= d.LockRetries {
+			return
+		}
+		time.Sleep(interval)
+	}
+}
+
+// lockDirName returns the name of the lock directory, see LockDir.
+func (d *Context) lockDirName() string {
+	return d.PidFileName + ".lock"
+}
+
+// removeStale removes the pid file, which does not refer to the running
+// daemon. The file is locked during the check, so the pid file of another
+// instance, which is starting, is left alone. Returns true if the file
+// is removed.
+func (d *Context) removeStale() bool {
+	// the pid file of another user is left to Reborn to report
+	if checkPidFileOwner(d.PidFileName, d.pidFileOwners()...) != nil {
+		return false
+	}
+	file, err := os.OpenFile(d.PidFileName, os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	lock := NewLockFile(file)
+	defer lock.Close()
+	if err = lock.TryLock(); err != nil {
+		return false
+	}
+	if pid, err := lock.ReadPid(); err == nil && IsProcessRunningAs(pid, d.ExecName, d.PidFileName) {
+		return false
+	}
+	// the file is removed before the lock is released
+	return os.Remove(d.PidFileName) == nil
+}
+
+// Start is like StartE, but prints the result. Start only returns in child,
+// in parent it exits.
+func (d *Context) Start() {
+	p, removed, err := d.start()
+	if removed {
+		fmt.Fprintln(d.out(), "removed stale pid file")
+	}
+	if errors.Is(err, ErrAlreadyRunning) {
+		fmt.Fprintln(d.out(), "daemon already running")
+		os.Exit(1)
+	} else if err != nil {
+		fmt.Fprintln(d.out(), "error:", err)
+		os.Exit(1)
+	}
+	if p != nil {
+		fmt.Fprintln(d.out(), "started")
+		os.Exit(0)
+	}
+}
+
+// Daemonize runs the program as a daemon in a single call. In parent
+// process it reborns the daemon and returns. In the daemon-process it calls
+// run and returns its result, or nil once SIGTERM or SIGINT is received
+// and OnStop returns. The pid file is released before return.
+//
+//	func main() {
+//		d := &daemon.Context{PidFileName: "/var/run/app.pid"}
+//		if err := d.Daemonize(serve); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+func (d *Context) Daemonize(run func() error) (err error) {
+	var child *os.Process
+	if child, err = d.Reborn(); err != nil || child != nil {
+		return
+	}
+	defer d.Release()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(ch)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run()
+	}()
+	select {
+	case err = <-done:
+	case <-ch:
+		d.stop()
+	}
+	return
+}
+
+// Run is like Daemonize, but main is the main loop of the daemon-process,
+// which never returns. In parent process Run reborns the daemon and returns.
+// In the daemon-process Run calls main and exits with status 0 once it
+// returns, or once SIGTERM or SIGINT is received and OnStop returns,
+// if StopOnSignal is set. The pid file is released before exit.
+// Run returns in the daemon-process only if Reborn fails.
+//
+//	func main() {
+//		d := &daemon.Context{PidFileName: "/var/run/app.pid"}
+//		if err := d.Run(serve); err != nil {
+//			log.Fatal(err)
+//		}
+//	}
+func (d *Context) Run(main func()) (err error) {
+	var child *os.Process
+	if child, err = d.Reborn(); err != nil || child != nil {
+		return
+	}
+
+	d.runMain(main)
+	d.Release()
+	os.Exit(0)
+	return
+}
+
+// runMain calls main and returns once it returns, or once SIGTERM or SIGINT
+// is received and OnStop returns, if StopOnSignal is set.
+func (d *Context) runMain(main func()) {
+	if !d.StopOnSignal {
+		main()
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(ch)
+	done := make(chan struct{})
+	go func() {
+		main()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ch:
+		d.stop()
+	}
+}
+
+// keepLocal copies Out, LogWriter and the callbacks, which can not be passed
+// by parent, into conf received by the daemon-process.
+func (d *Context) keepLocal(conf *Context) {
+	conf.Out = d.Out
+	conf.OnFork = d.OnFork
+	conf.OnStop = d.OnStop
+	conf.OnPrivileged = d.OnPrivileged
+	conf.LogWriter = d.LogWriter
+	conf.Logger = d.Logger
+}
+
+// stop calls OnStop and waits until it returns or StopTimeout passes.
+func (d *Context) stop() {
+	if d.OnStop == nil {
+		return
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if d.StopTimeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), d.StopTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		d.OnStop(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// Restart stops the running daemon, waits until it exits and releases
+// the pid file, then starts a new one like Start. If the daemon is not
+// running, Restart just calls Start.
+func (d *Context) Restart() {
+	stopped, err := d.stopWait()
+	if err != nil {
+		fmt.Fprintln(d.out(), "error:", err)
+		os.Exit(1)
+	}
+	if stopped {
+		fmt.Fprintln(d.out(), "stopped")
+	}
+	d.Start()
+}
+
+// stopWait sends StopSignal to the running daemon and waits until the process
+// exits and the pid file lock becomes free. Stale pid file is removed.
+// Reports whether the running daemon is stopped.
+func (d *Context) stopWait() (stopped bool, err error) {
+	timeout := d.RestartTimeout
+	if timeout == 0 {
+		timeout = RESTART_TIMEOUT
+	}
+	deadline := time.Now().Add(timeout)
+
+	p, _ := d.getRunningProcess()
+	if p != nil {
+		if err = sendSignal(p, d.stopSignal()); err != nil {
+			return
+		}
+		if !d.waitExit(p, deadline) {
+			return false, ErrStopTimeout
+		}
+		stopped = true
+	}
+
+	if len(d.PidFileName) == 0 {
+		return
+	}
+	var file *os.File
+	if file, err = os.OpenFile(d.PidFileName, os.O_RDWR, 0); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	lock := NewLockFile(file)
+	if err = lock.LockWithTimeout(time.Until(deadline)); err != nil {
+		lock.Close()
+		if err == ErrLockTimeout {
+			err = ErrStopTimeout
+		}
+		return
+	}
+	// nobody holds the pid file, so it is stale, unless the exited daemon
+	// has just removed it
+	if err = lock.Remove(); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
@@ -1,161 +1,822 @@
+//go:build !windows
+// +build !windows
+
 package daemon
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/syslog"
 	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
-// Mark of daemon process - system environment variable _GO_DAEMON=1
-const (
-	MARK_NAME  = "_GO_DAEMON"
-	MARK_VALUE = "1"
-)
-
-// Default file permissions for log and pid files.
-const FILE_PERM = os.FileMode(0640)
-
 // A Context describes daemon context.
+//
+// Parent process passes the context to the daemon-process encoded to JSON.
+// The daemon-process gets all exported fields, except files, writers and
+// callbacks, with the values they have in parent at the time of Reborn,
+// including Args and Env completed by Reborn. The values replace the ones
+// set in the daemon-process before Reborn. Unexported fields are not passed,
+// ExtraFiles are restored from inherited descriptors, see ExtraFile.
+// Writers and callbacks keep the values set in the daemon-process.
 type Context struct {
 	// If PidFileName is non-empty, parent process will try to create and lock
 	// pid file with given name. Child process writes process id to file.
+	// The existing pid file must be owned by the effective user of parent,
+	// or by the user of Credential with ChownFiles, otherwise Reborn fails
+	// with ErrPidFileOwner.
+	// The name is resolved by parent process, i.e. with Chroot the pid file
+	// is created outside of the new root, before the daemon-process changes
+	// root, and the daemon-process gets it as the open descriptor. Release
+	// removes it in its directory opened before chroot, except on BSD.
+	// Relative names of pid and log files are resolved against the working
+	// directory of parent, Reborn replaces them by absolute ones, so they
+	// refer to the same files in the daemon-process after WorkDir is applied.
 	PidFileName string
-	// Permissions for new pid file.
+	// PidFileLabel is the name of pid file in the daemon-process, e.g.
+	// the path of pid file inside Chroot. It is only a label, the file is
+	// not opened by the name. If empty, PidFileName is used.
+	PidFileLabel string
+	// Permissions for new pid file. If zero, FILE_PERM is used.
 	PidFilePerm os.FileMode
+	// PidFileInfo is written into pid file after the pid, e.g. version
+	// of the program, see WritePidInfo.
+	PidFileInfo map[string]string
+	// If PidFileHost is true, the hostname is written into pid file as
+	// "host=<hostname>", e.g. if pid files are on storage shared by hosts.
+	// The functions, which signal the daemon, refuse to signal the pid
+	// written by another host, see ErrOtherHost.
+	PidFileHost bool
+	// If the pid file is locked by another instance, e.g. the previous one
+	// is still exiting, Reborn retries to lock it LockRetries times,
+	// LockRetryInterval apart, before it fails with ErrWouldBlock, which
+	// StartE reports as ErrAlreadyRunning. If zero, it fails at once.
+	// If LockRetryInterval is zero, 100ms is used.
+	LockRetries       int
+	LockRetryInterval time.Duration
+	// If LockDir is true, a single instance is guaranteed by DirLock
+	// PidFileName+".lock" instead of the lock of pid file, e.g. if pid files
+	// are on NFS, where flock(2) is unreliable. The lock directory holds
+	// the pid of the daemon-process and is removed by Release, the lock left
+	// by a crashed daemon is taken over by the next start.
+	LockDir bool
 
 	// If LogFileName is non-empty, parent process will create file with given name
-	// and will link to fd 2 (stderr) for child process.
+	// and will link to fd 1 (stdout) and fd 2 (stderr) for child process.
 	LogFileName string
-	// Permissions for new log file.
+	// Permissions for new log file. If zero, FILE_PERM is used.
 	LogFilePerm os.FileMode
+	// Flags of opening LogFileName and StderrFileName by parent process,
+	// e.g. with os.O_TRUNC to start with empty log. They must include
+	// os.O_WRONLY or os.O_RDWR. If zero, os.O_WRONLY|os.O_CREATE|os.O_APPEND
+	// is used. ReopenLog always appends.
+	LogFileFlag int
+
+	// If StderrFileName is non-empty, parent process will create file with
+	// given name and will link to fd 2 (stderr) for child process, LogFileName
+	// is used only for stdout then.
+	StderrFileName string
+	// Permissions for new stderr file. If zero, FILE_PERM is used.
+	StderrFilePerm os.FileMode
+
+	// If UseSyslog is true, stdout and stderr of the daemon-process are sent
+	// line by line to syslog with given tag and facility (LOG_DAEMON if zero)
+	// and severity LOG_INFO. UseSyslog excludes LogFileName and StderrFileName.
+	// The lines are forwarded by a separate process, a copy of the program
+	// started by parent process, so output of a crashed daemon is not lost.
+	// SyslogNetwork and SyslogAddr are passed to syslog.Dial, empty values
+	// mean the local syslog server.
+	UseSyslog      bool
+	SyslogTag      string
+	SyslogFacility syslog.Priority
+	SyslogNetwork  string
+	SyslogAddr     string
+
+	// If LogWriter is non-nil, stdout and stderr of the daemon-process are
+	// written into a pipe, which parent process reads and copies into
+	// LogWriter, e.g. to add timestamps or to ship the output to a remote
+	// collector. LogWriter excludes LogFileName, StderrFileName and UseSyslog.
+	// The copying goroutine lives in parent process, so parent must keep
+	// running while the daemon writes, e.g. call Wait, which returns once
+	// the output is copied. Otherwise the daemon gets SIGPIPE on write.
+	LogWriter io.Writer `json:"-"`
 
 	// If WorkDir is non-empty, the child changes into the directory before
-	// creating the process.
+	// creating the process. With Chroot, WorkDir is relative to the new root
+	// and the daemon-process changes into it (or into "/" if WorkDir is empty)
+	// right after chroot.
 	WorkDir string
-	// If Chroot is non-empty, the child changes root directory
+	// If Chroot is non-empty, the child changes root directory.
+	// The daemon-process changes root, then working directory,
+	// then drops privileges. If either fails, Reborn fails in the
+	// daemon-process before privileges are dropped and the pid file is
+	// removed, the daemon never runs outside of the new root. The pid file
+	// lives outside of the new root, see PidFileName.
 	Chroot string
 
+	// MarkName and MarkValue give the environment variable, which marks
+	// the daemon-process. If empty, MARK_NAME and MARK_VALUE are used.
+	// Programs, which run each other, should use distinct marks.
+	MarkName  string
+	MarkValue string
+
 	// If Env is non-nil, it gives the environment variables for the
 	// daemon-process in the form returned by os.Environ.
 	// If it is nil, the result of os.Environ will be used.
 	Env []string
+	// If EnvFilter is non-nil, only the variables of Env, for which it
+	// returns true, are passed to the daemon-process, e.g. to leave out
+	// secrets. The mark of the daemon-process is always passed.
+	EnvFilter func(key, value string) bool `json:"-"`
 	// If Args is non-nil, it gives the command-line args for the
 	// daemon-process. If it is nil, the result of os.Args will be used
 	// (without program name).
 	Args []string
+	// Subcommand is the control argument of the program, which runs Start,
+	// e.g. "start" of "myd start". If Args is nil, its first occurrence
+	// is removed from os.Args, so the daemon-process does not start itself
+	// again. Otherwise Args must leave it out.
+	Subcommand string
+
+	// If ProcessName is non-empty, it replaces the program name (argv[0])
+	// of the daemon-process, which is shown by ps. On Linux the daemon-process
+	// also sets its command name (/proc/<pid>/comm), which is shown by top
+	// and killall, the kernel truncates it to 15 bytes. The executable and so
+	// the identification of the daemon by its executable are unchanged.
+	ProcessName string
+
+	// If DoubleFork is true, Reborn starts an intermediate process, which
+	// starts the daemon-process and exits. The daemon-process is reparented
+	// to init, so a parent, which keeps running, needs not to Wait for it.
+	// The process returned by Reborn is not a child then.
+	DoubleFork bool
+
+	// If NoSetsid is true, the daemon-process stays in the session and
+	// process group of the parent, e.g. to be run by a process supervisor.
+	// Otherwise it starts a new session, Reborn fails with ErrSetsid,
+	// if the kernel refuses it. If Setpgid is true, the
+	// daemon-process staying in the session starts a new process group.
+	NoSetsid bool
+	Setpgid  bool
+
+	// If StdinFile is non-nil, it is stdin of the daemon-process instead of
+	// /dev/null, e.g. a socket passed by a supervisor.
+	StdinFile *os.File `json:"-"`
+
+	// If SocketHandshake is true, parent passes the context to the
+	// daemon-process over a unix socket at descriptor 3 instead of a pipe
+	// at stdin, so the daemon-process has its stdin at descriptor 0 from
+	// the start. The daemon-process reports readiness over the same socket,
+	// see NotifyReady, and there is no readiness pipe after ExtraFiles.
+	SocketHandshake bool
+
+	// If KeepStdStreams is true, the daemon-process gets stdout and stderr
+	// of parent instead of /dev/null, e.g. to be captured by a process
+	// supervisor, like systemd or docker, along with NoSetsid. It excludes
+	// LogFileName, StderrFileName, UseSyslog and LogWriter.
+	KeepStdStreams bool
+
+	// If Foreground is true, the daemon-process is not detached, e.g. to run
+	// the program in foreground during development with the same code path:
+	// it stays in the session and process group of the parent and gets its
+	// stdin, stdout and stderr. NoSetsid, Setpgid, DoubleFork, LogFileName,
+	// StderrFileName, UseSyslog and LogWriter are ignored then, other
+	// options, e.g. WorkDir, Chroot and Credential, are applied as usual.
+	// To run the program in the current process instead, see StartForeground.
+	Foreground bool
+
+	// If NewPIDNamespace is true, the daemon-process is started in a new pid
+	// namespace, where it is pid 1 and reaps orphaned processes of the
+	// namespace. Once it exits, all processes of the namespace are killed.
+	// It requires privileges (CAP_SYS_ADMIN) and is supported on Linux only,
+	// it excludes DoubleFork. Parent process writes pid file, so it holds
+	// the pid of the daemon-process outside of the namespace.
+	NewPIDNamespace bool
+	// Cloneflags holds flags of clone(2), which start the daemon-process in
+	// new namespaces, e.g. syscall.CLONE_NEWNS to isolate mounts,
+	// CLONE_NEWUTS for hostname or CLONE_NEWNET for network. Only CLONE_NEW*
+	// flags are allowed, CLONE_NEWUSER is not supported. It requires
+	// privileges and is supported on Linux only. CLONE_NEWPID has the same
+	// effect as NewPIDNamespace.
+	// Files passed to the daemon-process, e.g. ExtraFiles, keep referring to
+	// the namespaces of parent, e.g. a listening socket of the host network.
+	// With CLONE_NEWNS mounts are still propagated to the host, if the root
+	// is a shared mount, the daemon-process should make it private first.
+	// Chroot is applied inside the new mount namespace as well.
+	Cloneflags uintptr
 
 	// Credential holds user and group identities to be assumed by a daemon-process.
+	// If it is nil, the identities of parent are kept. Otherwise both Uid
+	// and Gid are applied, zero ones as well, i.e. root. The daemon-process
+	// drops privileges itself after the setup, unless DropAtExec is set.
+	// If Credential.Groups is non-empty and NoSetGroups is false,
+	// the daemon-process sets the supplementary groups, unless InitGroups
+	// or ClearGroups is set.
 	Credential *syscall.Credential
-	// If Umask is non-zero, the daemon-process call Umask() func with given value.
-	Umask int
+	// If InitGroups is true and Credential is non-nil, the daemon-process
+	// sets supplementary groups of the Credential user, like initgroups(3).
+	// Otherwise supplementary groups are inherited from the parent.
+	InitGroups bool
+	// If ClearGroups is true, the daemon-process drops all supplementary
+	// groups before changing user. It excludes InitGroups.
+	ClearGroups bool
+	// Capabilities are the capabilities(7), which the daemon-process keeps
+	// after dropping privileges to Credential, e.g. CAP_NET_BIND_SERVICE (10)
+	// to bind ports below 1024. If non-empty, the privileges are dropped by
+	// the kernel at exec, so the daemon-process never runs as root: Chroot,
+	// OnPrivileged and other setup have only the given capabilities, e.g.
+	// Chroot requires CAP_SYS_CHROOT (18). The capabilities are raised in
+	// the ambient set, so programs run by the daemon-process inherit them.
+	// Requires Credential and Linux 4.3 or later, not supported on BSD.
+	Capabilities []uintptr
+	// If DropAtExec is true, the privileges are dropped to Credential by
+	// the kernel at exec, like with Capabilities, rather than by the
+	// daemon-process after the setup. The daemon-process never runs as root
+	// then, and neither do setuid or file capabilities of the executable
+	// apply as root, but the setup, which requires privileges, e.g. Chroot,
+	// raising Rlimits and OnPrivileged, fails. Requires Credential.
+	DropAtExec bool
+	// If ChownFiles is true, parent process changes the owner of pid file,
+	// LogFileName and StderrFileName to Credential, once it has opened
+	// them, so the daemon-process can rewrite them after dropping
+	// privileges, and so can the tools run as the user, e.g. logrotate.
+	// Requires Credential.
+	ChownFiles bool
+	// If Umask is non-zero or SetUmask is true, the daemon-process call
+	// Umask() func with given value. SetUmask allows to set umask 0, otherwise
+	// the daemon-process inherits umask of the parent.
+	Umask    int
+	SetUmask bool
+
+	// Rlimits gives resource limits of the daemon-process, keyed by resource
+	// (e.g. syscall.RLIMIT_NOFILE). Limits are applied before changing user,
+	// so hard limits can be raised by a privileged parent.
+	Rlimits map[int]syscall.Rlimit
+
+	// If CPUAffinity is non-empty, the daemon-process is bound to the CPUs
+	// with given numbers. It is supported on Linux only.
+	CPUAffinity []int
+	// If Nice is non-zero, the daemon-process sets its nice value.
+	// Negative values require privileges, they are applied before
+	// changing user.
+	Nice int
+	// If OOMScoreAdj is non-nil, the daemon-process sets its OOM score
+	// adjustment in range -1000..1000. Negative values require privileges.
+	// It is supported on Linux only.
+	OOMScoreAdj *int
+
+	// If CloseFDs is true, the daemon-process closes descriptors, which are
+	// inherited by the parent from its own parent by mistake, i.e. all
+	// descriptors without close-on-exec flag after the ones described
+	// by ExtraFiles.
+	CloseFDs bool
+
+	// If ExecPath is non-empty, the daemon-process runs the executable with
+	// given path, e.g. an upgraded copy of the program, instead of the
+	// executable of the current process, which is looked up in /proc. A name
+	// without path separators is searched in PATH. The status and stop
+	// functions identify the daemon by ExecName, set it to ExecPath, if
+	// the executables differ.
+	ExecPath string
+
+	// If ExecName is non-empty, the status and stop functions identify the
+	// daemon-process by its executable, given either by path or by base
+	// name, instead of the executable of the current process. It allows
+	// to check a daemon, whose binary is renamed or replaced.
+	ExecName string
+
+	// StopSignal is sent to the daemon by Stop. If zero, SIGTERM is used.
+	StopSignal syscall.Signal
+
+	// If StopTimeout is non-zero, Stop waits for the daemon to exit no longer
+	// than StopTimeout, then sends SIGKILL. Otherwise Stop waits unboundedly.
+	// The daemon is polled, so it is waited for, even if it is no child of
+	// the current process, and the pid file is removed once it exits.
+	StopTimeout time.Duration
+
+	// RestartTimeout limits how long Restart waits for the running daemon
+	// to exit and release the pid file. If zero, RESTART_TIMEOUT is used.
+	RestartTimeout time.Duration
+
+	// If StopOnSignal is true, Run exits the daemon-process once SIGTERM
+	// or SIGINT is received and OnStop returns, like Daemonize. Otherwise
+	// Run leaves signals to its main function.
+	StopOnSignal bool
+
+	// If QueueSignals is true, SIGHUP received by the daemon-process after
+	// Reborn is queued until Context.ServeSignals serves it. Set it only if
+	// the daemon-process calls Context.ServeSignals, SIGHUP is ignored until
+	// then. Otherwise SIGHUP has its default action.
+	QueueSignals bool
+
+	// Out receives messages of Start, Stop, Kill, Restart and Status.
+	// If it is nil, os.Stdout is used.
+	Out io.Writer `json:"-"`
+
+	// If Logger is non-nil, it receives debug messages about the steps of
+	// Reborn in parent and in the daemon-process, e.g. to find out why
+	// the daemon-process fails to initialize, and their errors. Logger set
+	// in the daemon-process before Reborn is kept there.
+	Logger Logger `json:"-"`
+
+	// OnFork is called in parent process once the daemon-process is started
+	// and has got the context. Its error is returned by Reborn, the started
+	// daemon-process keeps running.
+	OnFork func(child *os.Process) error `json:"-"`
+
+	// OnStop is called in the daemon-process by Context.ServeSignals and
+	// Daemonize, when SIGTERM or SIGINT is received, e.g. to drain
+	// connections. They wait for OnStop to return before the pid file is
+	// released, but no longer than StopTimeout, if it is non-zero: ctx is
+	// cancelled then.
+	OnStop func(ctx context.Context) `json:"-"`
+
+	// OnPrivileged is called in the daemon-process after Chroot and WorkDir
+	// are applied, but before the privileges are dropped to Credential, e.g.
+	// to bind a port below 1024. If it returns error, the daemon-process
+	// fails to start and removes the pid file, see WaitReady.
+	OnPrivileged func() error `json:"-"`
+
+	// ExtraFiles specifies additional open files to be inherited by the
+	// daemon-process, e.g. listening sockets. ExtraFiles[i] becomes descriptor
+	// 5+i in the daemon-process, after stdin, stdout, stderr, /dev/null (3),
+	// which is the socket of SocketHandshake, if it is set, and pid file (4),
+	// which is /dev/null if PidFileName is empty. The sockets of systemd
+	// socket activation follow, see ListenFiles. Unless SocketHandshake
+	// is set, the next descriptor is the readiness pipe, see NotifyReady.
+	// In the daemon-process ExtraFiles is restored from the descriptors,
+	// see ExtraFile.
+	ExtraFiles []*os.File `json:"-"`
 
 	// Struct contains only serializable public fields (!!!)
 	abspath  string
+	childPid int
 	pidFile  *LockFile
+	// directory of pid file opened before Chroot, see removePidFile
+	pidDir   *os.File
+	dirLock  *DirLock
 	logFile  *os.File
+	errFile  *os.File
 	nullFile *os.File
+	// sockets of systemd socket activation, duplicates in parent
+	listenFiles []*os.File
+	// closed once the output of the daemon-process is copied to LogWriter
+	logDone chan struct{}
+	// syslog forwarder in parent, see UseSyslog
+	forwarder *os.Process
+	// read end of readiness pipe in parent, write end in daemon-process
+	readyFile *os.File
 
 	rpipe, wpipe *os.File
+	readyWpipe   *os.File
 }
 
-// Reborn runs second copy of current process in the given context.
-// function executes separate parts of code in child process and parent process
-// and provides demonization of child process. It look similar as the
-// fork-daemonization, but goroutine-safe.
-// In success returns *os.Process in parent process and nil in child process.
-// Otherwise returns error.
-func (d *Context) Reborn() (child *os.Process, err error) {
-	if !WasReborn() {
-		child, err = d.parent()
-	} else {
-		err = d.child()
+// errGroups indicates conflicting options of supplementary groups.
+var errGroups = errors.New("InitGroups and ClearGroups are mutually exclusive")
+
+// errSetpgid indicates conflicting options of session.
+var errSetpgid = errors.New("Setpgid requires NoSetsid")
+
+// errPIDNamespace indicates conflicting options of process creation.
+var errPIDNamespace = errors.New("NewPIDNamespace and DoubleFork are mutually exclusive")
+
+// errCloneflags indicates flags of clone(2), which are not allowed.
+var errCloneflags = errors.New("Cloneflags allow only flags of new namespaces")
+
+// errCapabilities indicates Capabilities without user to retain them.
+var errCapabilities = errors.New("Capabilities require Credential")
+
+// errDropAtExec indicates DropAtExec without user to drop privileges to.
+var errDropAtExec = errors.New("DropAtExec requires Credential")
+
+// errChownFiles indicates ChownFiles without user to own the files.
+var errChownFiles = errors.New("ChownFiles requires Credential")
+
+// errOOMScoreAdj indicates invalid value of OOMScoreAdj.
+var errOOMScoreAdj = errors.New("OOMScoreAdj is out of range -1000..1000")
+
+// checkOptions reports conflicting or invalid options.
+func (d *Context) checkOptions() error {
+	if d.InitGroups && d.ClearGroups {
+		return errGroups
 	}
-	return
+	if d.Setpgid && !d.NoSetsid {
+		return errSetpgid
+	}
+	if d.newPIDNamespace() && d.DoubleFork {
+		return errPIDNamespace
+	}
+	if d.OOMScoreAdj != nil && (*d.OOMScoreAdj < -1000 || *d.OOMScoreAdj > 1000) {
+		return errOOMScoreAdj
+	}
+	if d.UseSyslog && (len(d.LogFileName) > 0 || len(d.StderrFileName) > 0) {
+		return errSyslog
+	}
+	if d.LogWriter != nil && (len(d.LogFileName) > 0 || len(d.StderrFileName) > 0 || d.UseSyslog) {
+		return errLogWriter
+	}
+	if d.KeepStdStreams && (len(d.LogFileName) > 0 || len(d.StderrFileName) > 0 || d.UseSyslog || d.LogWriter != nil) {
+		return errKeepStdStreams
+	}
+	if !validLogFileFlag(d.LogFileFlag) {
+		return errLogFileFlag
+	}
+	if len(d.Capabilities) > 0 && d.Credential == nil {
+		return errCapabilities
+	}
+	if d.DropAtExec && d.Credential == nil {
+		return errDropAtExec
+	}
+	if d.ChownFiles && d.Credential == nil {
+		return errChownFiles
+	}
+	return nil
 }
 
-// Search search daemons process by given in context pid file name.
-// If success returns pointer on daemons os.Process structure,
-// else returns error. Returns nil if filename is empty.
-func (d *Context) Search() (daemon *os.Process, err error) {
-	if len(d.PidFileName) > 0 {
-		var pid int
-		if pid, err = ReadPidFile(d.PidFileName); err != nil {
-			return
-		}
-		daemon, err = os.FindProcess(pid)
+// checkCredential reports the user or group of Credential, which does
+// not exist.
+func (d *Context) checkCredential() (err error) {
+	if d.Credential == nil {
+		return
 	}
+	if _, err = user.LookupId(strconv.Itoa(int(d.Credential.Uid))); err != nil {
+		return
+	}
+	_, err = user.LookupGroupId(strconv.Itoa(int(d.Credential.Gid)))
 	return
 }
 
-// WasReborn returns true in child process (daemon) and false in parent process.
-func WasReborn() bool {
-	return os.Getenv(MARK_NAME) == MARK_VALUE
-}
-
-func (d *Context) parent() (child *os.Process, err error) {
+func (d *Context) parent(ctx context.Context) (child *os.Process, err error) {
+	if err = d.checkOptions(); err != nil {
+		return
+	}
 	if err = d.prepareEnv(); err != nil {
-		panic(err)
+		return
 	}
 
-	defer d.closeFiles()
+	defer func() {
+		if err != nil && d.pidFile != nil {
+			d.pidFile.Remove()
+			d.pidFile = nil
+		}
+		if err != nil && d.dirLock != nil {
+			d.dirLock.Unlock()
+		}
+		if err != nil && d.readyFile != nil {
+			d.readyFile.Close()
+			d.readyFile = nil
+		}
+		d.closeFiles()
+	}()
 	if err = d.openFiles(); err != nil {
-		panic(err)
+		return
 	}
 
+	// with Chroot the daemon-process changes directory itself
+	dir := d.WorkDir
+	if len(d.Chroot) > 0 {
+		dir = ""
+	}
+	env := d.Env
+	if len(d.listenFiles) > 0 {
+		// the descriptors are passed at other numbers, see ListenFiles
+		env = withoutListenEnv(env)
+	}
+	if d.SocketHandshake {
+		env = append(env[:len(env):len(env)], handshakeEnvName+"=1")
+	}
 	attr := &os.ProcAttr{
-		Dir:   d.WorkDir,
-		Env:   d.Env,
+		Dir:   dir,
+		Env:   env,
 		Files: d.files(),
 		Sys: &syscall.SysProcAttr{
-			Setsid:     true,
+			Setsid:  !d.NoSetsid && !d.Foreground,
+			Setpgid: d.Setpgid && !d.Foreground,
 		},
 	}
-	if child, err = os.StartProcess(d.abspath, d.Args, attr); err != nil {
-		if d.pidFile != nil {
-			d.pidFile.Remove()
+	if err = setCloneflags(attr.Sys, d.Cloneflags, d.NewPIDNamespace); err != nil {
+		return
+	}
+	if d.dropsAtExec() {
+		if err = d.dropAtExec(attr.Sys); err != nil {
+			return
 		}
-		panic(err)
 	}
+	d.logger().Debugf("starting daemon-process %s %q", d.abspath, d.argv())
+	if d.DoubleFork && !d.Foreground {
+		child, err = d.doubleFork(attr)
+	} else {
+		child, err = os.StartProcess(d.abspath, d.argv(), attr)
+	}
+	if err != nil {
+		err = d.setsidError(err, attr.Sys)
+		return
+	}
+	d.childPid = child.Pid
 	d.rpipe.Close()
-	encoder := json.NewEncoder(d.wpipe)
-	err = encoder.Encode(d)
+	d.logger().Debugf("started daemon-process %d", child.Pid)
+	if d.newPIDNamespace() && d.pidFile != nil {
+		// the daemon-process knows only its pid inside the namespace
+		var info map[string]string
+		if info, err = d.pidFileInfo(); err == nil {
+			err = d.pidFile.writePidInfo(child.Pid, info)
+		}
+		if err == nil && d.dirLock != nil {
+			err = d.dirLock.SetOwner(child.Pid)
+		}
+		if err != nil {
+			child.Kill()
+			child.Wait()
+			return
+		}
+	}
+	err = d.sendConfig(ctx, child, config{Context: d, ExtraFilesNum: len(d.ExtraFiles), ListenNames: d.listenNames()})
+	if err == nil {
+		d.logger().Debugf("sent context to daemon-process %d", child.Pid)
+	}
+	if err == nil && d.SocketHandshake {
+		// the daemon-process reports readiness over the same socket
+		d.readyFile, d.wpipe = d.wpipe, nil
+	}
 
 	return
 }
 
-func (d *Context) openFiles() (err error) {
-	if d.PidFilePerm == 0 {
-		d.PidFilePerm = FILE_PERM
+// setsidError tells the failure of setsid(2) from other failures to start
+// the daemon-process. The process is refused a new session with EPERM,
+// if it is a process group leader, which the forked process is not normally,
+// so it is hard to diagnose. Other options, which may be refused with EPERM,
+// exclude this reason.
+func (d *Context) setsidError(err error, sys *syscall.SysProcAttr) error {
+	if sys.Setsid && d.Cloneflags == 0 && !d.NewPIDNamespace && !d.dropsAtExec() &&
+		errors.Is(err, syscall.EPERM) {
+		return fmt.Errorf("%w: %v", ErrSetsid, err)
+	}
+	return err
+}
+
+// dropsAtExec reports whether privileges of the daemon-process are dropped
+// at exec, see DropAtExec.
+func (d *Context) dropsAtExec() bool {
+	return d.DropAtExec || len(d.Capabilities) > 0
+}
+
+// dropAtExec makes the kernel drop privileges of the daemon-process
+// to Credential at exec, keeping Capabilities, if any.
+func (d *Context) dropAtExec(attr *syscall.SysProcAttr) (err error) {
+	var groups []int
+	if groups, err = d.groups(); err != nil {
+		return
 	}
-	if d.LogFilePerm == 0 {
-		d.LogFilePerm = FILE_PERM
+	cred := *d.Credential
+	cred.NoSetGroups = groups == nil
+	cred.Groups = nil
+	for _, g := range groups {
+		cred.Groups = append(cred.Groups, uint32(g))
 	}
+	attr.Credential = &cred
+	if len(d.Capabilities) > 0 {
+		err = setAmbientCaps(attr, d.Capabilities)
+	}
+	return
+}
+
+// groups returns supplementary groups of the daemon-process or nil,
+// if they are inherited from the parent.
+func (d *Context) groups() (groups []int, err error) {
+	if d.ClearGroups {
+		groups = []int{}
+	} else if d.Credential != nil && d.InitGroups {
+		groups, err = userGroups(d.Credential.Uid, d.Credential.Gid)
+	} else if d.Credential != nil && len(d.Credential.Groups) > 0 && !d.Credential.NoSetGroups {
+		for _, g := range d.Credential.Groups {
+			groups = append(groups, int(g))
+		}
+	}
+	return
+}
+
+// argv returns command-line args of the daemon-process, including
+// ProcessName.
+func (d *Context) argv() []string {
+	if len(d.ProcessName) == 0 {
+		return d.Args
+	}
+	return append([]string{d.ProcessName}, d.Args[1:]...)
+}
 
+// newPIDNamespace reports whether the daemon-process is started in new
+// pid namespace.
+func (d *Context) newPIDNamespace() bool {
+	return d.NewPIDNamespace || d.Cloneflags&cloneNewPID != 0
+}
+
+func (d *Context) openFiles() (err error) {
 	if d.nullFile, err = os.Open(os.DevNull); err != nil {
 		return
 	}
 
 	if len(d.PidFileName) > 0 {
-		if d.pidFile, err = OpenLockFile(d.PidFileName, d.PidFilePerm); err != nil {
+		// the pid file of another user is never opened, nor truncated
+		if err = checkPidFileOwner(d.PidFileName, d.pidFileOwners()...); err != nil {
 			return
 		}
-		if err = d.pidFile.Lock(); err != nil {
+		if d.pidFile, err = OpenLockFile(d.PidFileName, filePerm(d.PidFilePerm)); err != nil {
+			return
+		}
+		if err = d.lockPidFile(); err != nil {
+			// the pid file belongs to another instance, leave it alone
+			d.pidFile.Close()
+			d.pidFile = nil
+			d.dirLock = nil
 			return
 		}
 	}
 
-	if len(d.LogFileName) > 0 {
-		if d.logFile, err = os.OpenFile(d.LogFileName,
-			os.O_WRONLY|os.O_CREATE|os.O_APPEND, d.LogFilePerm); err != nil {
+	if d.listenFiles, err = activationFiles(); err != nil {
+		return
+	}
+	if !d.Foreground {
+		if err = d.openLogs(); err != nil {
+			return
+		}
+	}
+	if d.ChownFiles {
+		if err = d.chownFiles(); err != nil {
 			return
 		}
 	}
 
+	// the readiness pipe of the previous daemon-process, if the context
+	// is reused
+	if d.readyFile != nil {
+		d.readyFile.Close()
+		d.readyFile = nil
+	}
+	if d.SocketHandshake {
+		d.rpipe, d.wpipe, err = socketPair()
+		return
+	}
+	if d.readyFile, d.readyWpipe, err = os.Pipe(); err != nil {
+		return
+	}
 	d.rpipe, d.wpipe, err = os.Pipe()
 	return
 }
 
+// socketPair returns connected unix sockets of the handshake, see
+// SocketHandshake: the first one for the daemon-process, the second one
+// for parent.
+func socketPair() (child, parent *os.File, err error) {
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+	// the end of parent is pollable, so closeFiles interrupts
+	// the pending write of sendConfig
+	if err = syscall.SetNonblock(fds[1], true); err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return nil, nil, os.NewSyscallError("setnonblock", err)
+	}
+	return os.NewFile(uintptr(fds[0]), "handshake"), os.NewFile(uintptr(fds[1]), "handshake"), nil
+}
+
+// Environment variables of systemd socket activation, see sd_listen_fds(3).
+const (
+	listenPidEnvName   = "LISTEN_PID"
+	listenFdsEnvName   = "LISTEN_FDS"
+	listenNamesEnvName = "LISTEN_FDNAMES"
+)
+
+// Descriptor of the first socket passed by socket activation.
+const listenFdsStart = 3
+
+// activationFiles returns duplicates of the sockets, which systemd passed
+// to the current process by socket activation, named as LISTEN_FDNAMES
+// tells. The duplicates are passed to the daemon-process, so the descriptors
+// of the current process are never closed or moved. If the variables are
+// not set or meant for another process, it returns nil.
+func activationFiles() (files []*os.File, err error) {
+	if os.Getenv(listenPidEnvName) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	n, e := strconv.Atoi(os.Getenv(listenFdsEnvName))
+	if e != nil || n <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv(listenNamesEnvName), ":")
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		name := fmt.Sprintf("listen-fd-%d", fd)
+		if i < len(names) && len(names[i]) > 0 {
+			name = names[i]
+		}
+		syscall.ForkLock.RLock()
+		dup, e := syscall.Dup(fd)
+		if e == nil {
+			syscall.CloseOnExec(dup)
+		}
+		syscall.ForkLock.RUnlock()
+		if e != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, os.NewSyscallError("dup", e)
+		}
+		files = append(files, os.NewFile(uintptr(dup), name))
+	}
+	return
+}
+
+// withoutListenEnv returns env without the variables of socket activation,
+// which are wrong in the daemon-process.
+func withoutListenEnv(env []string) (res []string) {
+	for _, v := range env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if name != listenPidEnvName && name != listenFdsEnvName && name != listenNamesEnvName {
+			res = append(res, v)
+		}
+	}
+	return
+}
+
+// listenNames returns the names of sockets of socket activation.
+func (d *Context) listenNames() (names []string) {
+	for _, file := range d.listenFiles {
+		names = append(names, file.Name())
+	}
+	return
+}
+
+// pidFileOwners returns the users, besides the effective one, who may own
+// the existing pid file, i.e. the user of Credential with ChownFiles.
+func (d *Context) pidFileOwners() []int {
+	if d.ChownFiles && d.Credential != nil {
+		return []int{int(d.Credential.Uid)}
+	}
+	return nil
+}
+
+// chownFiles changes the owner of the open pid and log files to Credential,
+// see ChownFiles.
+func (d *Context) chownFiles() (err error) {
+	uid, gid := int(d.Credential.Uid), int(d.Credential.Gid)
+	if d.pidFile != nil {
+		if err = d.pidFile.Chown(uid, gid); err != nil {
+			return
+		}
+	}
+	// the log file may be a pipe to syslog or LogWriter
+	if d.logFile != nil && len(d.LogFileName) > 0 {
+		if err = d.logFile.Chown(uid, gid); err != nil {
+			return
+		}
+	}
+	if d.errFile != nil {
+		err = d.errFile.Chown(uid, gid)
+	}
+	return
+}
+
+// openLogs opens the files or starts the syslog writer for stdout and
+// stderr of the daemon-process.
+func (d *Context) openLogs() (err error) {
+	if len(d.LogFileName) > 0 {
+		if d.logFile, err = d.openLogFile(d.LogFileName, d.LogFilePerm); err != nil {
+			return
+		}
+	}
+	if len(d.StderrFileName) > 0 {
+		if d.errFile, err = d.openLogFile(d.StderrFileName, d.StderrFilePerm); err != nil {
+			return
+		}
+	}
+	if d.UseSyslog {
+		d.logFile, err = d.startSyslog()
+	}
+	if d.LogWriter != nil {
+		d.logFile, err = d.startLogWriter()
+	}
+	return
+}
+
 func (d *Context) closeFiles() (err error) {
 	cl := func(file **os.File) {
 		if *file != nil {
@@ -165,185 +826,601 @@ func (d *Context) closeFiles() (err error) {
 	}
 	cl(&d.rpipe)
 	cl(&d.wpipe)
+	cl(&d.readyWpipe)
 	cl(&d.logFile)
+	cl(&d.errFile)
 	cl(&d.nullFile)
+	for _, file := range d.listenFiles {
+		file.Close()
+	}
+	d.listenFiles = nil
 	if d.pidFile != nil {
 		d.pidFile.Close()
 		d.pidFile = nil
 	}
+	// the daemon-process owns the lock directory
+	d.dirLock = nil
 	return
 }
 
-func (d *Context) prepareEnv() (err error) {
-	// get the correct exec path even if process executed through symlink
-	if d.abspath, err = GetExecPath(os.Getpid()); err != nil {
-		panic(err)
+func (d *Context) files() (f []*os.File) {
+	if d.SocketHandshake {
+		f = []*os.File{
+			d.stdin(),  // (0) stdin
+			d.stdout(), // (1) stdout
+			d.stderr(), // (2) stderr
+			d.rpipe,    // (3) handshake socket
+		}
+	} else {
+		f = []*os.File{
+			d.rpipe,    // (0) stdin
+			d.stdout(), // (1) stdout
+			d.stderr(), // (2) stderr
+			d.stdin(),  // (3) dup on fd 0 after initialization
+		}
 	}
 
-	if len(d.Args) == 0 {
-		d.Args = os.Args
+	if d.pidFile != nil {
+		f = append(f, d.pidFile.File) // (4) pid file
+	} else {
+		f = append(f, d.nullFile) // (4) placeholder of pid file
 	}
-
-	mark := fmt.Sprintf("%s=%s", MARK_NAME, MARK_VALUE)
-	if len(d.Env) == 0 {
-		d.Env = os.Environ()
+	f = append(f, d.ExtraFiles...)  // (5...) extra files
+	f = append(f, d.listenFiles...) // (5+len(ExtraFiles)...) socket activation
+	if !d.SocketHandshake {
+		f = append(f, d.readyWpipe) // (5+len(ExtraFiles)+len(listenFiles)) readiness pipe
 	}
-	d.Env = append(d.Env, mark)
-
 	return
 }
 
-func (d *Context) files() (f []*os.File) {
-	log := d.nullFile
-	if d.logFile != nil {
-		log = d.logFile
-	}
+// Descriptor of the first extra file in the daemon-process.
+const extraFilesFd = 5
 
-	f = []*os.File{
-		d.rpipe,    // (0) stdin
-		log,        // (1) stdout
-		log,        // (2) stderr
-		d.nullFile, // (3) dup on fd 0 after initialization
-	}
+// Descriptor of the handshake socket in the daemon-process.
+const handshakeFd = 3
 
-	if d.pidFile != nil {
-		f = append(f, d.pidFile.File) // (4) pid file
+// Environment variable, which tells the daemon-process to read the context
+// from the handshake socket, see SocketHandshake.
+const handshakeEnvName = "_GO_DAEMON_HANDSHAKE"
+
+// config is sent by parent to the daemon-process.
+type config struct {
+	*Context
+	ExtraFilesNum int
+	// names of sockets of socket activation, which follow ExtraFiles
+	ListenNames []string
+	// ReExec is set by the daemon-process, which is replaced, see ReExec
+	ReExec bool
+}
+
+// decodeConfig reads the config sent by parent. Truncated or incomplete
+// config is an error, so the daemon-process never runs with a part of it.
+func decodeConfig(r io.Reader) (conf config, err error) {
+	// decode into a zero context, so maps and pointers set in the
+	// daemon-process are replaced rather than merged with the passed ones
+	conf = config{Context: new(Context)}
+	if err = json.NewDecoder(r).Decode(&conf); err != nil {
+		return conf, fmt.Errorf("decode context of parent: %w", err)
+	}
+	if err = conf.check(); err == nil && conf.ExtraFilesNum < 0 {
+		err = errIncompleteContext
 	}
 	return
 }
 
-var initialized = false
-
 func (d *Context) child() (err error) {
 	if initialized {
 		return os.ErrInvalid
 	}
 	initialized = true
 
-	decoder := json.NewDecoder(os.Stdin)
-	if err = decoder.Decode(d); err != nil {
-		return
+	// programs run by the daemon-process must not look for the socket
+	handshake := os.Getenv(handshakeEnvName) == "1"
+	os.Unsetenv(handshakeEnvName)
+	in := os.Stdin
+	if handshake {
+		syscall.CloseOnExec(handshakeFd)
+		in = os.NewFile(handshakeFd, "handshake")
 	}
 
-	if err = syscall.Close(0); err != nil {
+	var conf config
+	if conf, err = decodeConfig(in); err != nil {
 		return
 	}
-	if err = syscall.Dup2(3, 0); err != nil {
-		return
+	d.keepLocal(conf.Context)
+	*d = *conf.Context
+	d.logger().Debugf("read context of parent with %d extra files", conf.ExtraFilesNum)
+	d.ExtraFiles = make([]*os.File, conf.ExtraFilesNum)
+	for i := range d.ExtraFiles {
+		d.ExtraFiles[i] = os.NewFile(uintptr(extraFilesFd+i), fmt.Sprintf("extra-file-%d", i))
+	}
+	nextFd := extraFilesFd + conf.ExtraFilesNum
+	for i, name := range conf.ListenNames {
+		d.listenFiles = append(d.listenFiles, os.NewFile(uintptr(nextFd+i), name))
+	}
+	// the first descriptor after the ones of parent
+	nextFd += len(conf.ListenNames)
+	if handshake {
+		d.readyFile = in
+	} else {
+		syscall.CloseOnExec(nextFd)
+		d.readyFile = os.NewFile(uintptr(nextFd), "ready")
+		nextFd++
+	}
+
+	// on failure the pid file must not block the next start, and the parent
+	// waiting in WaitReady learns the reason
+	defer func() {
+		if err == nil {
+			return
+		}
+		if d.pidFile != nil && conf.ReExec {
+			// the lock belongs to the open file, the old daemon-process
+			// keeps both
+			d.pidFile.Close()
+			d.pidFile = nil
+		} else if d.pidFile != nil {
+			d.removePidFile()
+			d.pidFile = nil
+		}
+		if d.dirLock != nil && !conf.ReExec {
+			d.dirLock.Unlock()
+		}
+		d.dirLock = nil
+		fmt.Fprintf(d.readyFile, "ERROR=%v\n", err)
+		d.readyFile.Close()
+		d.readyFile = nil
+	}()
+
+	if !handshake {
+		if err = syscall.Close(0); err != nil {
+			return
+		}
+		if err = syscall.Dup2(3, 0); err != nil {
+			return
+		}
 	}
 
 	if len(d.PidFileName) > 0 {
-		d.pidFile = NewLockFile(os.NewFile(4, d.PidFileName))
-		if err = d.pidFile.WritePid(); err != nil {
+		label := d.PidFileLabel
+		if len(label) == 0 {
+			label = d.PidFileName
+		}
+		d.pidFile = NewLockFile(os.NewFile(4, label))
+		if d.LockDir {
+			// parent holds the lock directory for the daemon-process
+			d.dirLock = NewDirLock(d.lockDirName())
+		} else if err = d.pidFile.Lock(); err != nil {
+			// the lock of parent is inherited with the descriptor, locking
+			// it again succeeds, unless the lock is lost, the file may
+			// belong to another instance then
+			d.pidFile.Close()
+			d.pidFile = nil
+			return fmt.Errorf("lock pid file: %w", err)
+		}
+		// processes run by the daemon-process must not hold the lock
+		syscall.CloseOnExec(4)
+		if !d.newPIDNamespace() {
+			var info map[string]string
+			if info, err = d.pidFileInfo(); err != nil {
+				return
+			}
+			if err = d.pidFile.WritePidInfo(info); err != nil {
+				return
+			}
+			if d.dirLock != nil {
+				if err = d.dirLock.SetOwner(os.Getpid()); err != nil {
+					return
+				}
+			}
+			d.logger().Debugf("wrote pid file %s", d.PidFileName)
+		}
+	}
+	if d.CloseFDs {
+		// descriptors are listed before chroot hides /proc
+		if err = closeInheritedFds(nextFd); err != nil {
+			return
+		}
+	}
+	if d.OOMScoreAdj != nil && !conf.ReExec {
+		if err = setOOMScoreAdj(*d.OOMScoreAdj); err != nil {
+			return fmt.Errorf("oom_score_adj(%d): %v", *d.OOMScoreAdj, err)
+		}
+	}
+	if len(d.ProcessName) > 0 {
+		if err = setProcessName(d.ProcessName); err != nil {
+			return fmt.Errorf("set process name %q: %v", d.ProcessName, err)
+		}
+	}
+	// the rest is inherited from the replaced daemon-process, which may
+	// have no privileges to apply it
+	if conf.ReExec {
+		replacing = true
+		return
+	}
+	return d.applyAttrs()
+}
+
+// applyAttrs applies Umask, Chroot, Rlimits and the other attributes of
+// the process, calls OnPrivileged and drops the privileges to Credential.
+func (d *Context) applyAttrs() (err error) {
+	// groups are looked up before chroot hides the user database,
+	// unless the privileges are already dropped at exec
+	var groups []int
+	if !d.dropsAtExec() {
+		if groups, err = d.groups(); err != nil {
 			return
 		}
 	}
 
-	if d.Umask != 0 {
+	if d.Umask != 0 || d.SetUmask {
 		syscall.Umask(int(d.Umask))
 	}
-	if len(d.Chroot) > 0 {
-		err = syscall.Chroot(d.Chroot)
+	// threads are listed before chroot hides /proc
+	if len(d.CPUAffinity) > 0 {
+		if err = setAffinity(d.CPUAffinity); err != nil {
+			return fmt.Errorf("sched_setaffinity(%v): %v", d.CPUAffinity, err)
+		}
 	}
-	if d.Credential != nil {
-		if d.Credential.Gid > 0 {
-			if err = syscall.Setgid(int(d.Credential.Gid)); err != nil {
-				return
-			}
+	if d.Nice != 0 {
+		if err = setNice(d.Nice); err != nil {
+			return fmt.Errorf("setpriority(%d): %v", d.Nice, err)
 		}
-		if d.Credential.Uid > 0 {
-			if err = syscall.Setuid(int(d.Credential.Uid)); err != nil {
-				return
+	}
+	if len(d.Chroot) > 0 {
+		// the pid file is outside of the new root, see removePidFile
+		if d.pidFile != nil {
+			if dir, e := os.Open(filepath.Dir(d.PidFileName)); e == nil {
+				d.pidDir = dir
 			}
 		}
+		if err = syscall.Chroot(d.Chroot); err != nil {
+			return fmt.Errorf("chroot(%q): %v", d.Chroot, err)
+		}
+		d.logger().Debugf("changed root to %s", d.Chroot)
+		workDir := d.WorkDir
+		if len(workDir) == 0 {
+			workDir = "/"
+		}
+		if err = os.Chdir(workDir); err != nil {
+			return
+		}
+	}
+	for resource, rlimit := range d.Rlimits {
+		if err = syscall.Setrlimit(resource, &rlimit); err != nil {
+			return fmt.Errorf("setrlimit(%d, %+v): %v", resource, rlimit, err)
+		}
+	}
+	if d.OnPrivileged != nil {
+		if err = d.OnPrivileged(); err != nil {
+			return fmt.Errorf("OnPrivileged: %w", err)
+		}
+		d.logger().Debugf("called OnPrivileged")
+	}
+	if groups != nil {
+		if err = syscall.Setgroups(groups); err != nil {
+			return
+		}
+	}
+	if d.Credential != nil && !d.dropsAtExec() {
+		if err = syscall.Setgid(int(d.Credential.Gid)); err != nil {
+			return
+		}
+		if err = syscall.Setuid(int(d.Credential.Uid)); err != nil {
+			return
+		}
+		d.logger().Debugf("dropped privileges to uid %d gid %d", d.Credential.Uid, d.Credential.Gid)
 	}
 
 	return
 }
 
-// Release provides correct pid-file release in daemon.
-func (d *Context) Release() (err error) {
-	if !initialized {
+// errForeground indicates options, which can not be applied to the running
+// process by StartForeground.
+var errForeground = errors.New("StartForeground excludes DropAtExec, Capabilities, NewPIDNamespace and Cloneflags")
+
+// StartForeground runs main in the current process instead of the
+// daemon-process, e.g. as pid 1 of a container, which must not detach,
+// so the same program runs as a daemon or in foreground by a flag.
+// Nothing is forked and the process keeps its session, stdin, stdout
+// and stderr: LogFileName, StderrFileName, UseSyslog and LogWriter are
+// ignored. Otherwise the context is applied as in the daemon-process:
+// the pid file is created with the pid of the current process, WorkDir,
+// Chroot, Umask and the other attributes are applied, OnPrivileged is
+// called and the privileges are dropped to Credential, then main is called.
+// StartForeground returns nil once main returns, or once SIGTERM or SIGINT
+// is received and OnStop returns, if StopOnSignal is set. The pid file is
+// released before return. The attributes are never restored, and the context
+// can not be reborn in the process then.
+func (d *Context) StartForeground(main func()) (err error) {
+	if initialized {
+		return os.ErrInvalid
+	}
+	if err = d.checkOptions(); err != nil {
 		return
 	}
+	if d.dropsAtExec() || d.newPIDNamespace() {
+		return errForeground
+	}
+	initialized = true
+
+	if len(d.PidFileName) > 0 {
+		if err = checkPidFileOwner(d.PidFileName, d.pidFileOwners()...); err != nil {
+			return
+		}
+		if d.pidFile, err = OpenLockFile(d.PidFileName, filePerm(d.PidFilePerm)); err != nil {
+			return
+		}
+		if err = d.lockPidFile(); err != nil {
+			d.pidFile.Close()
+			d.pidFile = nil
+			d.dirLock = nil
+			return
+		}
+	}
+	defer d.Release()
+	if d.ChownFiles {
+		if err = d.chownFiles(); err != nil {
+			return
+		}
+	}
 	if d.pidFile != nil {
-		err = d.pidFile.Remove()
+		var info map[string]string
+		if info, err = d.pidFileInfo(); err != nil {
+			return
+		}
+		if err = d.pidFile.WritePidInfo(info); err != nil {
+			return
+		}
+		d.logger().Debugf("wrote pid file %s", d.PidFileName)
+	}
+	// with Chroot WorkDir is applied inside the new root
+	if len(d.WorkDir) > 0 && len(d.Chroot) == 0 {
+		if err = os.Chdir(d.WorkDir); err != nil {
+			return
+		}
 	}
+	if err = d.applyAttrs(); err != nil {
+		return
+	}
+	d.logger().Debugf("running in foreground %d", os.Getpid())
+	d.runMain(main)
 	return
 }
 
-func (d *Context) Status() {
-	p, _ := d.Search()
-	if p == nil {
-		fmt.Println("stopped")
-		os.Exit(1)
-	} else if IsProcessRunning(p.Pid, d.PidFileName) {
-		fmt.Println("running")
-		os.Exit(0)
-	} else {
-		fmt.Println("crashed")
-		os.Exit(1)
+// removePidFile removes the pid file of the daemon-process. With Chroot the
+// file is outside of the new root, it is removed in its directory opened
+// before chroot then, unless it is not supported, i.e. besides Linux. The file is
+// removed before the lock is released.
+func (d *Context) removePidFile() (err error) {
+	if d.pidDir == nil {
+		return d.pidFile.Remove()
 	}
+	defer func() {
+		d.pidDir.Close()
+		d.pidDir = nil
+	}()
+	if err = unlinkAt(d.pidDir, filepath.Base(d.PidFileName)); err == syscall.ENOTSUP {
+		return d.pidFile.Remove()
+	}
+	d.pidFile.Close()
+	return
 }
 
-func (d *Context) getRunningProcess() (*os.Process, error){
-	p, err := d.Search()
+// closeInheritedFds closes descriptors starting from min, which have no
+// close-on-exec flag, so they are inherited through exec. Descriptors
+// opened by the process itself, including the ones of Go runtime, always
+// have the flag.
+func closeInheritedFds(min int) error {
+	dir, err := os.Open("/proc/self/fd")
 	if err != nil {
-		return nil, err
-	} else if (p != nil && IsProcessRunning(p.Pid, d.PidFileName)) {
-		return p, nil
+		if dir, err = os.Open("/dev/fd"); err != nil {
+			return err
+		}
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fd, err := strconv.Atoi(name)
+		if err != nil || fd < min {
+			continue
+		}
+		flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0)
+		if errno == 0 && flags&syscall.FD_CLOEXEC == 0 {
+			syscall.Close(fd)
+		}
 	}
-	return nil, err
+	return nil
 }
 
-func (d *Context) Stop() {
-	p, _ := d.getRunningProcess()
-	if p == nil {
-		fmt.Println("not running")
+// userGroups returns the group list of the user with given uid, including
+// given primary gid, as initgroups(3) does.
+func userGroups(uid, gid uint32) (groups []int, err error) {
+	var u *user.User
+	if u, err = user.LookupId(strconv.Itoa(int(uid))); err != nil {
 		return
 	}
-	if err := p.Signal(syscall.SIGTERM); err != nil {
-		panic(err)
+	var ids []string
+	if ids, err = u.GroupIds(); err != nil {
+		return
 	}
-	p.Wait()
-	fmt.Println("stopped")
-	os.Remove(d.PidFileName)
+	groups = []int{int(gid)}
+	for _, id := range ids {
+		var g int
+		if g, err = strconv.Atoi(id); err != nil {
+			return
+		}
+		if g != int(gid) {
+			groups = append(groups, g)
+		}
+	}
+	return
 }
 
-func (d *Context) Kill() {
-	p, _ := d.getRunningProcess()
-	if p == nil {
-		fmt.Println("not running")
+// ReopenLog opens LogFileName and StderrFileName again and replaces stdout
+// and stderr of the daemon-process by them, e.g. after rotation of logs.
+// The new file is opened before the old one is replaced, so no output is lost.
+// ReopenLog may be used as a handler of Context.ServeSignals:
+//
+//	d.ServeSignals(map[syscall.Signal]func() error{syscall.SIGUSR1: d.ReopenLog})
+//
+// The names are absolute, see PidFileName, with Chroot they are resolved
+// inside the new root. In Foreground ReopenLog does nothing.
+func (d *Context) ReopenLog() (err error) {
+	if d.Foreground {
 		return
 	}
-	if err := p.Kill(); err != nil {
-		panic(err)
+	if len(d.LogFileName) > 0 {
+		if err = reopenFile(d.LogFileName, filePerm(d.LogFilePerm), 1); err != nil {
+			return
+		}
+		if len(d.StderrFileName) == 0 {
+			if err = syscall.Dup2(1, 2); err != nil {
+				return
+			}
+		}
+	}
+	if len(d.StderrFileName) > 0 {
+		err = reopenFile(d.StderrFileName, filePerm(d.StderrFilePerm), 2)
+	}
+	return
+}
+
+// reopenFile opens the named file for appending and duplicates it on fd.
+func reopenFile(name string, perm os.FileMode, fd int) (err error) {
+	var file *os.File
+	if file, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, perm); err != nil {
+		return
+	}
+	defer file.Close()
+	return syscall.Dup2(int(file.Fd()), fd)
+}
+
+// ExtraFile returns i-th file of ExtraFiles in the daemon-process,
+// or nil if there is no such file.
+func (d *Context) ExtraFile(i int) *os.File {
+	if i < 0 || i >= len(d.ExtraFiles) {
+		return nil
+	}
+	return d.ExtraFiles[i]
+}
+
+// ListenFiles returns the sockets, which systemd passed to parent process
+// by socket activation, see sd_listen_fds(3), in the daemon-process. Parent
+// passes them after ExtraFiles, rather than at descriptors 3 and above, and
+// removes LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES from the environment
+// of the daemon-process. Names of the files are taken from LISTEN_FDNAMES,
+// "listen-fd-N" by default. It returns nil in parent process or without
+// socket activation.
+func (d *Context) ListenFiles() []*os.File {
+	return d.listenFiles
+}
+
+// NotifyReady tells the parent process, which waits in WaitReady, that
+// the daemon-process is initialized and serving. It is called once
+// in the daemon-process, like sd_notify(3) with READY=1 of systemd.
+func (d *Context) NotifyReady() (err error) {
+	if d.readyFile == nil || !d.WasReborn() {
+		return os.ErrInvalid
+	}
+	defer func() {
+		d.readyFile.Close()
+		d.readyFile = nil
+	}()
+	if _, err = d.readyFile.Write([]byte("READY=1\n")); err == nil {
+		replacing = false
 	}
-	fmt.Println("killed")
-	os.Remove(d.PidFileName)
+	return
 }
 
-//Start() only return in child, will os.Exit in parent if success
-func (d *Context) Start() {
-	p, err := d.Search()
-	if p != nil {
-		if IsProcessRunning(p.Pid, d.PidFileName) {
-			fmt.Println("daemon already running")
-			os.Exit(1)
+// WaitReady blocks in parent process until the daemon-process started by
+// the last successful Reborn calls NotifyReady. If the daemon-process
+// fails to initialize or exits before, ErrNotReady is returned, wrapped with
+// the reason of the failure or the exit status, and the pid file left by
+// the daemon-process is removed. The failed daemon-process is reaped, unless
+// DoubleFork is set, it is killed, if it keeps running past timeout. If it
+// does not get ready within timeout or sends an invalid notification,
+// the daemon-process is killed and ErrReadyTimeout or the error is returned.
+func (d *Context) WaitReady(timeout time.Duration) (err error) {
+	if d.readyFile == nil || d.WasReborn() {
+		return os.ErrInvalid
+	}
+	r := d.readyFile
+	d.readyFile = nil
+	defer r.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- readReady(r)
+	}()
+
+	expired := time.After(timeout)
+	select {
+	case err = <-done:
+		if err == nil {
+			return
 		}
+	case <-expired:
+		err = ErrReadyTimeout
 	}
-	p, err = d.Reborn()
-	if err != nil {
-		fmt.Println("error:", err)
-		os.Exit(1)
+	if p, e := os.FindProcess(d.childPid); e == nil {
+		if !errors.Is(err, ErrNotReady) {
+			p.Kill()
+		}
+		// reap the child, it fails with DoubleFork
+		exited := make(chan *os.ProcessState, 1)
+		go func() {
+			state, _ := p.Wait()
+			exited <- state
+		}()
+		var state *os.ProcessState
+		select {
+		case state = <-exited:
+		case <-expired:
+			// the daemon-process has failed, but keeps running
+			p.Kill()
+			state = <-exited
+		}
+		if err == ErrNotReady && state != nil {
+			// the daemon-process has exited, its status tells why
+			err = fmt.Errorf("%w: %v", ErrNotReady, state)
+		}
+	}
+	d.removeStalePidFile(d.childPid)
+	return
+}
+
+// readReady reads the readiness pipe until the daemon-process calls
+// NotifyReady or fails. ErrNotReady is returned, if the pipe is closed.
+func readReady(r io.Reader) error {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	switch {
+	case line == "READY=1\n":
+		return nil
+	case strings.HasPrefix(line, "ERROR="):
+		return fmt.Errorf("%w: %s", ErrNotReady, strings.TrimSpace(line[len("ERROR="):]))
+	case err == io.EOF:
+		return ErrNotReady
+	case err != nil:
+		return err
 	}
-	if p != nil {
-		fmt.Println("started")
-		os.Exit(0)
+	return fmt.Errorf("invalid readiness notification %q", line)
+}
+
+// SendSignal sends sig to the running daemon, e.g. SIGHUP to reload it.
+// Returns the same errors as StopE, if the daemon is not running.
+func (d *Context) SendSignal(sig syscall.Signal) error {
+	p, err := d.getRunningProcess()
+	if err != nil {
+		return err
 	}
+	return sendSignal(p, sig)
 }
 
-func (d *Context) Restart() {
-	d.Stop()
-	d.Start()
+func sendSignal(p *os.Process, sig syscall.Signal) error {
+	return p.Signal(sig)
 }
@@ -1,10 +1,33 @@
+//go:build !windows
+// +build !windows
+
 package daemon
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"log/syslog"
+	"net"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
+	"testing"
 	"time"
 )
 
@@ -66,3 +89,3482 @@ func Example() {
 		log.Println("Error:", err)
 	}
 }
+
+func ExampleContext_Daemonize() {
+	dmn := &Context{
+		PidFileName: "/var/run/daemon.pid",
+		LogFileName: "/var/log/daemon.log",
+	}
+	err := dmn.Daemonize(func() error {
+		// Run main operation
+		ln, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			return err
+		}
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return err
+			}
+			conn.Close()
+		}
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func ExampleContext_Run() {
+	dmn := &Context{
+		PidFileName:  "/var/run/daemon.pid",
+		LogFileName:  "/var/log/daemon.log",
+		StopOnSignal: true,
+	}
+	err := dmn.Run(func() {
+		// Run main operation
+		ln, err := net.Listen("tcp", ":8080")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			conn.Close()
+		}
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
+
+func TestRebornOpenFilesError(test *testing.T) {
+	dmn := &Context{PidFileName: invalidname}
+	child, err := dmn.Reborn()
+	if err == nil {
+		test.Fatal("Reborn(): Error was not detected on invalid pid file name")
+	}
+	if child != nil {
+		test.Fatal("Reborn(): child process was started")
+	}
+}
+
+func TestValidate(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	dir := filepath.Dir(dmn.PidFileName)
+	dmn.WorkDir = dir
+	if err := dmn.Validate(); err != nil {
+		test.Fatal(err)
+	}
+	for _, name := range []string{dmn.PidFileName, dmn.LogFileName} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			test.Fatal("Validate(): file was created:", err)
+		}
+	}
+
+	// the lock of running daemon is kept
+	lock, err := CreatePidFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+	if err = dmn.Validate(); err != nil {
+		test.Fatal(err)
+	}
+	if !dmn.pidFileLocked() {
+		test.Fatal("Validate(): pid file was unlocked")
+	}
+
+	invalid := []func(d *Context){
+		func(d *Context) { d.PidFileName = filepath.Join(dir, "missing", "pid") },
+		func(d *Context) { d.LogFileName = filepath.Join(dmn.PidFileName, "log") },
+		func(d *Context) { d.Chroot = filepath.Join(dir, "missing") },
+		func(d *Context) { d.WorkDir = dmn.PidFileName },
+		func(d *Context) { d.Credential = &syscall.Credential{Uid: 4242424} },
+		func(d *Context) { d.Credential = &syscall.Credential{Gid: 4242424} },
+		func(d *Context) { d.InitGroups, d.ClearGroups = true, true },
+	}
+	if os.Getuid() != 0 {
+		// root may write everywhere
+		readonly := filepath.Join(dir, "readonly")
+		if err = os.Mkdir(readonly, 0555); err != nil {
+			test.Fatal(err)
+		}
+		invalid = append(invalid, func(d *Context) { d.PidFileName = filepath.Join(readonly, "pid") })
+	}
+	for i, set := range invalid {
+		d := *dmn
+		set(&d)
+		if err = d.Validate(); err == nil {
+			test.Errorf("Validate(): Error was not detected in case %d", i)
+		}
+	}
+}
+
+func TestRebornReleasesPidFile(test *testing.T) {
+	dmn := &Context{
+		PidFileName: filename,
+		PidFilePerm: fileperm,
+		LogFileName: invalidname,
+	}
+	if _, err := dmn.Reborn(); err == nil {
+		test.Fatal("Reborn(): Error was not detected on invalid log file name")
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		test.Fatal("Reborn(): pid file was not removed:", err)
+	}
+
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal("pid file lock was not released:", err)
+	}
+	lock.Remove()
+}
+
+func TestOpenFilesDefaultPerm(test *testing.T) {
+	dmn := newTestContext(test, "")
+	dmn.PidFilePerm = 0
+	dmn.StderrFileName = filepath.Join(filepath.Dir(dmn.PidFileName), "stderr")
+	for i := 0; i < 2; i++ {
+		if err := dmn.openFiles(); err != nil {
+			test.Fatal(err)
+		}
+		dmn.pidFile.Remove()
+		dmn.pidFile = nil
+		dmn.closeFiles()
+		if dmn.PidFilePerm != 0 || dmn.LogFilePerm != 0 || dmn.StderrFilePerm != 0 {
+			test.Fatalf("openFiles() changed permissions: %v %v %v",
+				dmn.PidFilePerm, dmn.LogFilePerm, dmn.StderrFilePerm)
+		}
+	}
+	for _, name := range []string{dmn.LogFileName, dmn.StderrFileName} {
+		if fi, err := os.Stat(name); err != nil || fi.Mode().Perm() != FILE_PERM {
+			test.Fatal("permissions of new file:", fi.Mode(), err)
+		}
+	}
+}
+
+func TestStopWait(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	child := startHelper(test, dmn)
+
+	if stopped, err := dmn.stopWait(); err != nil || !stopped {
+		test.Fatal("stopWait():", stopped, err)
+	}
+	if _, err := child.Wait(); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+}
+
+func TestOut(test *testing.T) {
+	out := new(bytes.Buffer)
+	dmn := newTestContext(test, "serve")
+	dmn.Out = out
+	dmn.Stop()
+	dmn.Kill()
+
+	startHelper(test, dmn)
+	dmn.Stop()
+	startHelper(test, dmn)
+	dmn.Kill()
+	child := startHelper(test, dmn)
+	if _, err := dmn.stopWait(); err != nil {
+		test.Fatal(err)
+	}
+	child.Wait()
+
+	// stopWait leaves the output to Restart
+	expected := "not running\nnot running\nstopped\nkilled\n"
+	if out.String() != expected {
+		test.Fatalf("output: %q, expected: %q", out.String(), expected)
+	}
+}
+
+// outEnvName is the environment variable that selects the verb run
+// by TestOutExit in the test binary.
+const outEnvName = "_GO_DAEMON_TEST_OUT"
+
+func TestOutExit(test *testing.T) {
+	// the verbs exit, so they are called in a copy of the test binary
+	if verb := os.Getenv(outEnvName); verb != "" {
+		dmn := &Context{PidFileName: os.Getenv("PID_FILE"), Out: os.Stderr}
+		switch verb {
+		case "status":
+			dmn.Status()
+		case "start":
+			dmn.Start()
+		}
+		return
+	}
+
+	dmn := newTestContext(test, "")
+	lock, err := CreatePidFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+
+	verbs := map[string]string{"status": "running\n", "start": "daemon already running\n"}
+	for verb, expected := range verbs {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestOutExit$")
+		cmd.Env = append(os.Environ(), outEnvName+"="+verb, "PID_FILE="+dmn.PidFileName)
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+		stdout, _ := cmd.Output()
+		if len(stdout) != 0 || stderr.String() != expected {
+			test.Errorf("%s: stdout: %q, stderr: %q, expected: %q", verb, stdout, stderr, expected)
+		}
+	}
+}
+
+// launchEnvName is the environment variable, which makes TestReplacedBinary
+// in a copy of the test binary reborn the daemon with given pid file.
+const launchEnvName = "_GO_DAEMON_TEST_LAUNCH"
+
+func TestReplacedBinary(test *testing.T) {
+	if name := os.Getenv(launchEnvName); name != "" {
+		dmn := &Context{
+			PidFileName: name,
+			LogFileName: name + ".log",
+			Env:         append(os.Environ(), launchEnvName+"=", helperEnvName+"=serve"),
+		}
+		if _, err := dmn.Reborn(); err != nil {
+			test.Fatal(err)
+		}
+		return
+	}
+
+	dmn := newTestContext(test, "")
+	data, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		test.Fatal(err)
+	}
+	// the daemon is started from a copy of the binary with the same name
+	app := filepath.Join(filepath.Dir(dmn.PidFileName), "v1", filepath.Base(os.Args[0]))
+	if err = os.Mkdir(filepath.Dir(app), 0755); err != nil {
+		test.Fatal(err)
+	}
+	if err = ioutil.WriteFile(app, data, 0755); err != nil {
+		test.Fatal(err)
+	}
+	cmd := exec.Command(app, "-test.run=^TestReplacedBinary$")
+	cmd.Env = append(os.Environ(), launchEnvName+"="+dmn.PidFileName)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		test.Fatalf("%v: %s", err, out)
+	}
+	var pid int
+	for i := 0; i < 100 && pid == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		pid, _ = ReadPidFile(dmn.PidFileName)
+	}
+	defer syscall.Kill(pid, syscall.SIGKILL)
+
+	// the binary of the daemon is deleted and the pid file is written
+	// by an older version long ago
+	if err = os.Remove(app); err != nil {
+		test.Fatal(err)
+	}
+	if err = ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprintln(pid)), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(dmn.PidFileName, old, old); err != nil {
+		test.Fatal(err)
+	}
+
+	if state, err := dmn.State(); err != nil || state != StateRunning {
+		test.Fatal("State():", state, err)
+	}
+	if _, err = dmn.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE(): expected ErrAlreadyRunning, got", err)
+	}
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := dmn.State(); err != nil || state != StateStopped {
+		test.Fatal("State() after StopE():", state, err)
+	}
+}
+
+func TestStopWaitStalePidFile(test *testing.T) {
+	dmn := newTestContext(test, "")
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte("1"), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if stopped, err := dmn.stopWait(); err != nil || stopped {
+		test.Fatal("stopWait():", stopped, err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("stale pid file was not removed:", err)
+	}
+}
+
+func TestState(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if state, err := dmn.State(); err != nil || state != StateStopped {
+		test.Fatal("State():", state, err)
+	}
+
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprint(deadPid(test))), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := dmn.State(); err != nil || state != StateCrashed {
+		test.Fatal("State():", state, err)
+	}
+
+	// pid is reused by an unrelated process
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		test.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprint(cmd.Process.Pid)), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(dmn.PidFileName, old, old); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := dmn.State(); err != nil || state != StateCrashed {
+		test.Fatal("State():", state, err)
+	}
+	os.Remove(dmn.PidFileName)
+
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+	if state, err := dmn.State(); err != nil || state != StateRunning {
+		test.Fatal("State():", state, err)
+	}
+}
+
+func TestExecPath(test *testing.T) {
+	dmn := newTestContext(test, "exe")
+	dmn.ExecPath = copyExec(test, filepath.Dir(dmn.PidFileName))
+	if err := dmn.Validate(); err != nil {
+		test.Fatal(err)
+	}
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, dmn.ExecPath+"\n")
+
+	// the file is not executable
+	dmn = newTestContext(test, "exe")
+	dmn.ExecPath = filepath.Join(filepath.Dir(dmn.PidFileName), "app")
+	if err := ioutil.WriteFile(dmn.ExecPath, nil, 0644); err != nil {
+		test.Fatal(err)
+	}
+	if err := dmn.Validate(); err == nil {
+		test.Fatal("Validate(): Error was not detected on not executable ExecPath")
+	}
+	if _, err := dmn.Reborn(); err == nil {
+		test.Fatal("Reborn(): Error was not detected on not executable ExecPath")
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was created:", err)
+	}
+}
+
+func TestSubcommand(test *testing.T) {
+	args := os.Args
+	defer func() { os.Args = args }()
+	os.Args = []string{args[0], "-v", "start", "start"}
+
+	for _, c := range []struct{ subcommand, log string }{
+		{"", "[-v start start]\n"},
+		{"start", "[-v start]\n"},
+		{"stop", "[-v start start]\n"},
+	} {
+		dmn := newTestContext(test, "args")
+		dmn.Args = nil
+		dmn.Subcommand = c.subcommand
+		child := startHelper(test, dmn)
+		child.Wait()
+		waitLog(test, dmn, c.log)
+	}
+	if len(os.Args) != 4 || os.Args[2] != "start" {
+		test.Fatal("os.Args is modified:", os.Args)
+	}
+}
+
+func TestEnvFilter(test *testing.T) {
+	os.Setenv("SECRET_TOKEN", "secret")
+	defer os.Unsetenv("SECRET_TOKEN")
+
+	dmn := newTestContext(test, "secret")
+	name, _ := dmn.mark()
+	dmn.EnvFilter = func(key, value string) bool {
+		// the mark can not be filtered out
+		return !strings.HasPrefix(key, "SECRET_") && key != name
+	}
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "\"\"\n")
+	for _, kv := range dmn.Env {
+		if strings.HasPrefix(kv, "SECRET_") {
+			test.Fatal("Env is not filtered:", kv)
+		}
+	}
+}
+
+func TestRelativeNames(test *testing.T) {
+	dmn := newTestContext(test, "names")
+	dir := filepath.Dir(dmn.PidFileName)
+	dmn.WorkDir = filepath.Join(dir, "work")
+	if err := os.Mkdir(dmn.WorkDir, 0755); err != nil {
+		test.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		test.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if dir, err = os.Getwd(); err != nil {
+		test.Fatal(err)
+	}
+
+	dmn.PidFileName, dmn.LogFileName = "pid", "log"
+	child, err := dmn.Reborn()
+	if err != nil {
+		test.Fatal(err)
+	}
+	child.Wait()
+	pidName, logName := filepath.Join(dir, "pid"), filepath.Join(dir, "log")
+	if dmn.PidFileName != pidName || dmn.LogFileName != logName {
+		test.Fatal("names in parent:", dmn.PidFileName, dmn.LogFileName)
+	}
+	waitLog(test, dmn, fmt.Sprintln(pidName, logName, "work"))
+}
+
+func TestResolvedPidFile(test *testing.T) {
+	dmn := newTestContext(test, "resolved")
+	dir := filepath.Dir(dmn.PidFileName)
+	dmn.WorkDir = filepath.Join(dir, "work")
+	if err := os.Mkdir(dmn.WorkDir, 0755); err != nil {
+		test.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		test.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if dir, err = os.Getwd(); err != nil {
+		test.Fatal(err)
+	}
+
+	dmn.PidFileName = ""
+	if name := dmn.ResolvedPidFile(); name != "" {
+		test.Fatal("ResolvedPidFile() without pid file:", name)
+	}
+	dmn.PidFileName = "pid"
+	expected := filepath.Join(dir, "pid")
+	if name := dmn.ResolvedPidFile(); name != expected {
+		test.Fatal("ResolvedPidFile() before Reborn:", name)
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+	if name := dmn.ResolvedPidFile(); name != expected {
+		test.Fatal("ResolvedPidFile() after Reborn:", name)
+	}
+	if pid, err := ReadPidFile(expected); pid != child.Pid || err != nil {
+		test.Fatal("pid file is not created at resolved name:", pid, err)
+	}
+	// the daemon-process resolves it the same way after changing directory
+	waitLog(test, dmn, fmt.Sprintln(expected, "work"))
+}
+
+func TestStatusInfo(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	info, err := dmn.StatusInfo()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if (info != StatusInfo{State: StateStopped, PidFile: dmn.PidFileName}) {
+		test.Fatalf("StatusInfo() of stopped daemon: %+v", info)
+	}
+
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+	if info, err = dmn.StatusInfo(); err != nil {
+		test.Fatal(err)
+	}
+	exe, err := GetExecPath(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if info.State != StateRunning || info.PID != child.Pid || info.Uptime <= 0 ||
+		info.ExePath != exe || info.PidFile != dmn.PidFileName {
+		test.Fatalf("StatusInfo() of running daemon: %+v", info)
+	}
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		test.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		test.Fatal(err)
+	}
+	if len(decoded) != 5 || decoded["state"] != "running" || decoded["pid"] != float64(child.Pid) ||
+		decoded["uptime"] != float64(info.Uptime) || decoded["exe_path"] != exe || decoded["pid_file"] != dmn.PidFileName {
+		test.Fatalf("StatusInfo() in JSON: %s", data)
+	}
+}
+
+func TestStartStopE(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if err := dmn.StopE(); err != ErrNoPidFile {
+		test.Fatal("StopE(): expected ErrNoPidFile, got", err)
+	}
+
+	child := startHelper(test, dmn)
+	if _, err := dmn.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE(): expected ErrAlreadyRunning, got", err)
+	}
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	// StopE waits for the daemon, which is a child of the test process
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not stopped:", err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+}
+
+func TestStalePidFile(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	for _, content := range []string{fmt.Sprintln(deadPid(test)), "garbage\n"} {
+		if err := ioutil.WriteFile(dmn.PidFileName, []byte(content), fileperm); err != nil {
+			test.Fatal(err)
+		}
+		if err := dmn.StopE(); !errors.Is(err, ErrStalePidFile) || !errors.Is(err, ErrNotRunning) {
+			test.Errorf("StopE() for %q: %v", content, err)
+		}
+		if err := dmn.KillE(); !errors.Is(err, ErrStalePidFile) {
+			test.Errorf("KillE() for %q: %v", content, err)
+		}
+		if err := dmn.SendSignal(syscall.SIGHUP); !errors.Is(err, ErrStalePidFile) {
+			test.Errorf("SendSignal() for %q: %v", content, err)
+		}
+	}
+
+	os.Remove(dmn.PidFileName)
+	if err := dmn.StopE(); !errors.Is(err, ErrNotRunning) || errors.Is(err, ErrStalePidFile) {
+		test.Error("StopE() without pid file:", err)
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+	if _, err := dmn.StartE(); !errors.Is(err, ErrAlreadyRunning) {
+		test.Error("StartE() for running daemon:", err)
+	}
+}
+
+func TestIsRunning(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if running, err := dmn.IsRunning(); running || err != nil {
+		test.Fatal("IsRunning() without pid file:", running, err)
+	}
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprintln(deadPid(test))), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if running, err := dmn.IsRunning(); running || err != nil {
+		test.Fatal("IsRunning() with stale pid file:", running, err)
+	}
+	os.Remove(dmn.PidFileName)
+
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	if running, err := dmn.IsRunning(); !running || err != nil {
+		test.Fatal("IsRunning() of running daemon:", running, err)
+	}
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if running, err := dmn.IsRunning(); running || err != nil {
+		test.Fatal("IsRunning() of stopped daemon:", running, err)
+	}
+}
+
+func TestProbePidFile(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if _, _, err := ProbePidFile(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("ProbePidFile() without pid file:", err)
+	}
+	pid := deadPid(test)
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprintln(pid)), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if p, held, err := ProbePidFile(dmn.PidFileName); p != pid || held || err != nil {
+		test.Fatal("ProbePidFile() of stale pid file:", p, held, err)
+	}
+	os.Remove(dmn.PidFileName)
+
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	for i := 0; i < 2; i++ {
+		if p, held, err := ProbePidFile(dmn.PidFileName); p != child.Pid || !held || err != nil {
+			test.Fatal("ProbePidFile() of running daemon:", p, held, err)
+		}
+	}
+	// the probe does not release the lock of the daemon
+	lock, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Close()
+	if err = lock.TryLock(); err != ErrWouldBlock {
+		test.Fatal("TryLock() of probed pid file:", err)
+	}
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestConcurrentStart(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	dmn.LockRetries = 2
+	dmn.LockRetryInterval = 10 * time.Millisecond
+
+	type result struct {
+		child *os.Process
+		err   error
+	}
+	results := make(chan result, 2)
+	for i := 0; i < 2; i++ {
+		ctx := *dmn
+		go func() {
+			child, err := ctx.StartE()
+			results <- result{child, err}
+		}()
+	}
+	var started []*os.Process
+	for i := 0; i < 2; i++ {
+		if r := <-results; r.err == nil {
+			started = append(started, r.child)
+		} else if r.err != ErrAlreadyRunning {
+			test.Error("StartE():", r.err)
+		}
+	}
+	for _, child := range started {
+		defer child.Wait()
+	}
+	if len(started) != 1 {
+		test.Fatal("expected exactly one started daemon, got", len(started))
+	}
+	waitPidFile(test, dmn, started[0])
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestLockRetries(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	lock, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Close()
+	if err = lock.TryLock(); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = dmn.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE() without retries:", err)
+	}
+
+	// the previous instance releases the pid file meanwhile
+	dmn.LockRetries = 20
+	dmn.LockRetryInterval = 20 * time.Millisecond
+	time.AfterFunc(100*time.Millisecond, func() { lock.Unlock() })
+	child, err := dmn.StartE()
+	if err != nil {
+		test.Fatal("StartE() with retries:", err)
+	}
+	defer child.Wait()
+	waitPidFile(test, dmn, child)
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestLockDir(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	dmn.LockDir = true
+	lock := NewDirLock(dmn.PidFileName + ".lock")
+	// the lock of crashed daemon
+	if err := lock.TryLock(deadPid(test)); err != nil {
+		test.Fatal(err)
+	}
+
+	child, err := dmn.StartE()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer child.Wait()
+	waitPidFile(test, dmn, child)
+	if pid, err := lock.Owner(); pid != child.Pid || err != nil {
+		test.Fatal("owner of lock directory:", pid, err)
+	}
+	// the pid file is not locked, the directory is
+	other := *dmn
+	if _, err = other.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE() of second instance: expected ErrAlreadyRunning, got", err)
+	}
+	if running, err := dmn.IsRunning(); !running || err != nil {
+		test.Fatal("IsRunning():", running, err)
+	}
+
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = os.Stat(lock.Name); !os.IsNotExist(err) {
+		test.Fatal("lock directory was not removed:", err)
+	}
+}
+
+func TestPidFileOwner(test *testing.T) {
+	if os.Geteuid() != 0 {
+		test.Skip("requires root")
+	}
+	dmn := newTestContext(test, "serve")
+	// the pid file of the daemon of another user
+	content := fmt.Sprintln(deadPid(test))
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(content), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if err := os.Chown(dmn.PidFileName, 65534, 65534); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := dmn.Validate(); !errors.Is(err, ErrPidFileOwner) {
+		test.Fatal("Validate(): expected ErrPidFileOwner, got", err)
+	}
+	if _, err := dmn.StartE(); !errors.Is(err, ErrPidFileOwner) {
+		test.Fatal("StartE(): expected ErrPidFileOwner, got", err)
+	}
+	if data, err := ioutil.ReadFile(dmn.PidFileName); string(data) != content || err != nil {
+		test.Fatalf("pid file of another user was changed: %q, %v", data, err)
+	}
+}
+
+func TestProbe(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if r, err := dmn.Probe(); r != (ProbeResult{}) || err != nil {
+		test.Fatalf("Probe() without pid file: %+v, %v", r, err)
+	}
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(dmn.PidFileName, []byte(content), fileperm); err != nil {
+			test.Fatal(err)
+		}
+	}
+	pid := deadPid(test)
+	write(fmt.Sprintln(pid))
+	if r, err := dmn.Probe(); r != (ProbeResult{PID: pid, PidFile: true}) || err != nil {
+		test.Fatalf("Probe() of stale pid file: %+v, %v", r, err)
+	}
+
+	// the pid is reused by another program
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		test.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	write(fmt.Sprintf("%d\nstart=1\n", cmd.Process.Pid))
+	r, err := dmn.Probe()
+	if r != (ProbeResult{PID: cmd.Process.Pid, PidFile: true, Alive: true}) || r.Healthy() || err != nil {
+		test.Fatalf("Probe() of reused pid: %+v, %v", r, err)
+	}
+	os.Remove(dmn.PidFileName)
+
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	if r, err = dmn.Probe(); !r.Healthy() || !r.StartMatch || !r.ExecMatch || r.PID != child.Pid || err != nil {
+		test.Fatalf("Probe() of running daemon: %+v, %v", r, err)
+	}
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+}
+
+func TestStopEReasons(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if err := dmn.StopE(); err != ErrNoPidFile {
+		test.Fatal("StopE() without pid file:", err)
+	}
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(dmn.PidFileName, []byte(content), fileperm); err != nil {
+			test.Fatal(err)
+		}
+	}
+	pid := deadPid(test)
+	write(fmt.Sprintln(pid))
+	err := dmn.StopE()
+	if !errors.Is(err, ErrProcessGone) || !errors.Is(err, ErrStalePidFile) ||
+		!strings.Contains(err.Error(), fmt.Sprint("pid ", pid)) {
+		test.Error("StopE() for dead process:", err)
+	}
+
+	// the pid is reused by another program
+	cmd := exec.Command("sleep", "10")
+	if err = cmd.Start(); err != nil {
+		test.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	write(fmt.Sprintf("%d\n%s=1\n", cmd.Process.Pid, pidStartKey))
+	err = dmn.StopE()
+	if !errors.Is(err, ErrStalePidFile) || errors.Is(err, ErrProcessGone) ||
+		!strings.Contains(err.Error(), fmt.Sprint("pid ", cmd.Process.Pid)) {
+		test.Error("StopE() for another process:", err)
+	}
+
+	write("garbage\n")
+	if err = dmn.StopE(); !errors.Is(err, ErrStalePidFile) || errors.Is(err, ErrProcessGone) {
+		test.Error("StopE() for invalid pid file:", err)
+	}
+	if _, err = os.Stat(dmn.PidFileName); err != nil {
+		test.Fatal("stale pid file was removed:", err)
+	}
+}
+
+func TestStartStalePidFile(test *testing.T) {
+	dmn := newTestContext(test, "")
+	stale := fmt.Sprintln(deadPid(test))
+	if err := ioutil.WriteFile(dmn.PidFileName, []byte(stale), fileperm); err != nil {
+		test.Fatal(err)
+	}
+
+	// the pid file of another instance, which is starting, is left alone
+	lock, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = lock.Lock(); err != nil {
+		test.Fatal(err)
+	}
+	if _, err = dmn.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE() for locked pid file:", err)
+	}
+	lock.Close()
+	if data, _ := ioutil.ReadFile(dmn.PidFileName); string(data) != stale {
+		test.Fatalf("pid file was changed: %q", data)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestOutExit$")
+	cmd.Env = append(os.Environ(), outEnvName+"=start", "PID_FILE="+dmn.PidFileName)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err = cmd.Run(); err != nil {
+		test.Fatal(err, stderr)
+	}
+	if expected := "removed stale pid file\nstarted\n"; stderr.String() != expected {
+		test.Fatalf("output: %q, expected: %q", stderr, expected)
+	}
+}
+
+func TestPidFileHost(test *testing.T) {
+	host, err := os.Hostname()
+	if err != nil {
+		test.Fatal(err)
+	}
+	dmn := newTestContext(test, "serve")
+	dmn.PidFileHost = true
+	dmn.PidFileInfo = map[string]string{"version": "1.0"}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+
+	if name, err := ReadPidHost(dmn.PidFileName); err != nil || name != host {
+		test.Fatalf("ReadPidHost(): %q, expected %q, %v", name, host, err)
+	}
+	if state, err := dmn.State(); state != StateRunning || err != nil {
+		test.Fatal("State():", state, err)
+	}
+
+	// the same pid on another host is not signaled
+	other := fmt.Sprintf("%d\nhost=%s.other\n", child.Pid, host)
+	if err = ioutil.WriteFile(dmn.PidFileName, []byte(other), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := dmn.State(); state != StateStopped || !errors.Is(err, ErrOtherHost) {
+		test.Error("State():", state, err)
+	}
+	if err = dmn.StopE(); !errors.Is(err, ErrOtherHost) || !strings.Contains(err.Error(), host+".other") {
+		test.Error("StopE():", err)
+	}
+	if err = dmn.KillE(); !errors.Is(err, ErrOtherHost) {
+		test.Error("KillE():", err)
+	}
+	if err = dmn.SendSignal(syscall.SIGTERM); !errors.Is(err, ErrOtherHost) {
+		test.Error("SendSignal():", err)
+	}
+	if !IsProcessRunning(child.Pid) {
+		test.Fatal("daemon was signaled")
+	}
+}
+
+func TestStartELocked(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	// the daemon, which is starting, has not written its pid yet
+	lock, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Close()
+	if err = lock.TryLock(); err != nil {
+		test.Fatal(err)
+	}
+
+	if _, err = dmn.StartE(); err != ErrAlreadyRunning {
+		test.Fatal("StartE(): expected ErrAlreadyRunning, got", err)
+	}
+	if _, err = os.Stat(dmn.PidFileName); err != nil {
+		test.Fatal("pid file of another instance was removed:", err)
+	}
+}
+
+func TestKillE(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if err := dmn.KillE(); err != ErrNoPidFile {
+		test.Fatal("KillE(): expected ErrNoPidFile, got", err)
+	}
+
+	child := startHelper(test, dmn)
+	if err := dmn.KillE(); err != nil {
+		test.Fatal(err)
+	}
+	// KillE waits for the daemon, i.e. reaps the child of the test
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not killed:", err)
+	}
+}
+
+func TestStopNotChild(test *testing.T) {
+	dmn := newTestContext(test, "slowstop")
+	// the daemon-process is reaped by init, as if it is stopped by another
+	// invocation of the program
+	dmn.DoubleFork = true
+	startHelper(test, dmn)
+	waitLog(test, dmn, "ready\n")
+
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	// the pid file is kept, until the daemon exits, which is no child
+	waitLog(test, dmn, "ready\ntrue\n")
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file is not removed:", err)
+	}
+}
+
+func TestStopSignal(test *testing.T) {
+	dmn := newTestContext(test, "trap")
+	dmn.StopSignal = syscall.SIGQUIT
+	startHelper(test, dmn)
+	waitLog(test, dmn, "ready\n")
+
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	waitLog(test, dmn, fmt.Sprintf("ready\n%d\n", syscall.SIGQUIT))
+}
+
+func TestStopTimeout(test *testing.T) {
+	dmn := newTestContext(test, "ignore")
+	dmn.StopTimeout = 300 * time.Millisecond
+	child := startHelper(test, dmn)
+	waitLog(test, dmn, "ready\n")
+
+	start := time.Now()
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if time.Since(start) < dmn.StopTimeout {
+		test.Fatal("daemon exited before timeout")
+	}
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not killed:", err)
+	}
+}
+
+func TestStopWithPolicy(test *testing.T) {
+	// graceful
+	dmn := newTestContext(test, "serve")
+	child := startHelper(test, dmn)
+	if err := dmn.StopWithPolicy(StopPolicy{Timeout: 5 * time.Second}); err != nil {
+		test.Fatal(err)
+	}
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not stopped:", err)
+	}
+
+	// the daemon ignores the signal
+	dmn = newTestContext(test, "ignore")
+	child = startHelper(test, dmn)
+	waitLog(test, dmn, "ready\n")
+	policy := StopPolicy{Timeout: 300 * time.Millisecond}
+	if err := dmn.StopWithPolicy(policy); err != ErrStopTimeout {
+		test.Fatal("StopWithPolicy() without escalation:", err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); err != nil {
+		test.Fatal("pid file of running daemon was removed:", err)
+	}
+	policy.Escalate = true
+	if err := dmn.StopWithPolicy(policy); err != nil {
+		test.Fatal(err)
+	}
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not killed:", err)
+	}
+
+	// force
+	dmn = newTestContext(test, "ignore")
+	child = startHelper(test, dmn)
+	waitLog(test, dmn, "ready\n")
+	start := time.Now()
+	if err := dmn.StopWithPolicy(StopPolicy{Signal: syscall.SIGKILL, Timeout: 5 * time.Second}); err != nil {
+		test.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		test.Fatal("daemon was not stopped at once")
+	}
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Fatal("daemon was not killed:", err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+}
+
+func TestContextServeSignals(test *testing.T) {
+	dmn := newTestContext(test, "hup")
+	// SIGHUP stays ignored in the daemon until it starts serving signals
+	signal.Ignore(syscall.SIGHUP)
+	child := startHelper(test, dmn)
+	signal.Reset(syscall.SIGHUP)
+
+	for i := 0; ; i++ {
+		if err := child.Signal(syscall.SIGHUP); err != nil {
+			test.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if data, _ := ioutil.ReadFile(dmn.LogFileName); strings.HasPrefix(string(data), "hup\n") {
+			break
+		} else if i == 100 {
+			test.Fatal("SIGHUP handler was not called")
+		}
+	}
+
+	if err := child.Signal(syscall.SIGTERM); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("daemon was not stopped gracefully:", state, err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not released:", err)
+	}
+}
+
+func TestServeSignalsQueued(test *testing.T) {
+	dmn := newTestContext(test, "queuedhup")
+	dmn.QueueSignals = true
+	child := startHelper(test, dmn)
+	state, err := child.Wait()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !state.Success() {
+		test.Fatal("daemon was not stopped by the handler:", state)
+	}
+	waitLog(test, dmn, "hup\n")
+}
+
+func TestOnStop(test *testing.T) {
+	for _, timeout := range []time.Duration{0, 100 * time.Millisecond} {
+		dmn := newTestContext(test, "drain")
+		dmn.StopTimeout = timeout
+		child := startHelper(test, dmn)
+		if err := dmn.WaitReady(5 * time.Second); err != nil {
+			test.Fatal(err)
+		}
+		if err := dmn.SendSignal(syscall.SIGTERM); err != nil {
+			test.Fatal(err)
+		}
+		child.Wait()
+
+		expected := "drained\nreleased true\n"
+		if timeout > 0 {
+			expected = "released true\n"
+		}
+		waitLog(test, dmn, expected)
+		if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+			test.Fatal("pid file was not removed:", err)
+		}
+	}
+}
+
+func TestSendSignal(test *testing.T) {
+	dmn := newTestContext(test, "usr1")
+	if err := dmn.SendSignal(syscall.SIGUSR1); err != ErrNoPidFile {
+		test.Fatal("SendSignal() before start:", err)
+	}
+	child := startHelper(test, dmn)
+	if err := dmn.WaitReady(5 * time.Second); err != nil {
+		test.Fatal(err)
+	}
+
+	if err := dmn.SendSignal(syscall.SIGUSR1); err != nil {
+		test.Fatal(err)
+	}
+	waitLog(test, dmn, "usr1\n")
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("daemon exited with", state, err)
+	}
+	if err := dmn.SendSignal(syscall.SIGUSR1); err != ErrNoPidFile {
+		test.Fatal("SendSignal() after exit:", err)
+	}
+}
+
+func TestDaemonize(test *testing.T) {
+	dmn := newTestContext(test, "daemonize")
+	err := dmn.Daemonize(func() error {
+		test.Error("run is called in parent")
+		return nil
+	})
+	if err != nil {
+		test.Fatal(err)
+	}
+	child, err := os.FindProcess(dmn.ChildPid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	waitLog(test, dmn, "run\n")
+
+	if err = child.Signal(syscall.SIGTERM); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("daemon was not stopped gracefully:", state, err)
+	}
+	if _, err = os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not released:", err)
+	}
+}
+
+func TestUptime(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if _, err := dmn.Uptime(); err != ErrNoPidFile {
+		test.Fatal("Uptime(): expected ErrNoPidFile, got", err)
+	}
+
+	before := time.Now()
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+	time.Sleep(500 * time.Millisecond)
+
+	uptime, err := dmn.Uptime()
+	if err != nil {
+		test.Fatal(err)
+	}
+	// the start time has precision of clock ticks
+	if elapsed := time.Since(before); uptime < 450*time.Millisecond || uptime > elapsed+50*time.Millisecond {
+		test.Fatalf("Uptime(): %v, expected 500ms..%v", uptime, elapsed)
+	}
+}
+
+func TestSupervise(test *testing.T) {
+	start := func(fails int) *Context {
+		dmn := newTestContext(test, "supervise")
+		counter := filepath.Join(filepath.Dir(dmn.PidFileName), "counter")
+		dmn.Env = append(dmn.Env, fmt.Sprint(failsEnvName, "=", fails, " ", counter))
+		child := startHelper(test, dmn)
+		if fails >= 0 {
+			child.Wait()
+		}
+		return dmn
+	}
+
+	// crashed worker is restarted
+	dmn := start(2)
+	waitLog(test, dmn, "run 1\ncrash\nrun 2\ncrash\nrun 3\n")
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+
+	// supervisor gives up after MaxRestarts, the worker crashing at once
+	// is restarted after the least delay, which doubles
+	begin := time.Now()
+	dmn = start(3)
+	if elapsed := time.Since(begin); elapsed < 3*minRestartBackoff {
+		test.Fatal("worker was restarted without delay:", elapsed)
+	}
+	data, _ := ioutil.ReadFile(dmn.LogFileName)
+	if !strings.HasPrefix(string(data), "run 1\ncrash\nrun 2\ncrash\nrun 3\ncrash\n") ||
+		!strings.Contains(string(data), ErrRestartLimit.Error()) {
+		test.Fatalf("log content: %q", data)
+	}
+
+	// supervisor stops the worker
+	dmn = start(-1)
+	waitLog(test, dmn, "run 1\nready\n")
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+}
+
+func TestChildPid(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	if pid := dmn.ChildPid(); pid != 0 {
+		test.Fatal("ChildPid() before Reborn:", pid)
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+
+	pid, err := ReadPidFile(dmn.PidFileName)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if dmn.ChildPid() != pid {
+		test.Fatalf("ChildPid(): %d, pid file: %d", dmn.ChildPid(), pid)
+	}
+}
+
+func TestOnFork(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	var forked *os.Process
+	dmn.OnFork = func(child *os.Process) error {
+		forked = child
+		return nil
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+	if forked == nil || forked.Pid != child.Pid || forked.Pid != dmn.ChildPid() {
+		test.Fatal("OnFork(): unexpected child", forked)
+	}
+
+	errFork := errors.New("fork")
+	dmn = newTestContext(test, "serve")
+	dmn.OnFork = func(*os.Process) error { return errFork }
+	child, err := dmn.Reborn()
+	if err != errFork {
+		test.Fatal("Reborn(): expected error of OnFork, got", err)
+	}
+	defer child.Wait()
+	defer child.Kill()
+}
+
+func TestWait(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	if _, err := dmn.Wait(); err != ErrNotRunning {
+		test.Fatal("Wait() before Reborn:", err)
+	}
+	child := startHelper(test, dmn)
+	waitLog(test, dmn, "stdout\nstderr\n")
+
+	state, err := dmn.Wait()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if !state.Success() {
+		test.Error("Wait(): daemon exited with", state)
+	}
+	if err = syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Error("daemon process was not reaped:", err)
+	}
+}
+
+func TestDoubleFork(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	dmn.DoubleFork = true
+	// startHelper checks that the daemon-process wrote its pid
+	child := startHelper(test, dmn)
+	waitLog(test, dmn, "stdout\nstderr\n")
+
+	if _, err := dmn.Wait(); err == nil {
+		test.Error("Wait(): daemon-process is a child")
+	}
+	// the daemon-process is reaped by init, the parent keeps running
+	for i := 0; i < 100; i++ {
+		if err := syscall.Kill(child.Pid, 0); err == syscall.ESRCH {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	line, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", child.Pid))
+	test.Errorf("daemon process remains: %s", line)
+}
+
+func TestWaitReady(test *testing.T) {
+	dmn := newTestContext(test, "ready")
+	if err := dmn.NotifyReady(); err != os.ErrInvalid {
+		test.Error("NotifyReady() in parent:", err)
+	}
+	start := time.Now()
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+
+	if err := dmn.WaitReady(5 * time.Second); err != nil {
+		test.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		test.Error("WaitReady() returned before daemon was ready:", elapsed)
+	}
+	if err := syscall.Kill(child.Pid, 0); err != nil {
+		test.Error("daemon is not running:", err)
+	}
+}
+
+func TestRebornTwice(test *testing.T) {
+	dmn := newTestContext(test, "ready")
+	out := new(syncBuffer)
+	dmn.LogFileName = ""
+	dmn.LogWriter = out
+	for i := 0; i < 2; i++ {
+		child := startHelper(test, dmn)
+		if err := dmn.WaitReady(5 * time.Second); err != nil {
+			test.Fatalf("WaitReady() of daemon %d: %v", i, err)
+		}
+		child.Kill()
+		if _, err := dmn.Wait(); err != nil {
+			test.Fatalf("Wait() of daemon %d: %v", i, err)
+		}
+	}
+	name, value := dmn.mark()
+	mark := 0
+	for _, v := range dmn.Env {
+		if v == name+"="+value {
+			mark++
+		}
+	}
+	if mark != 1 {
+		test.Errorf("the mark is %d times in Env", mark)
+	}
+}
+
+func TestWaitReadyTimeout(test *testing.T) {
+	dmn := newTestContext(test, "ignore")
+	child := startHelper(test, dmn)
+
+	if err := dmn.WaitReady(200 * time.Millisecond); err != ErrReadyTimeout {
+		test.Fatal("WaitReady():", err)
+	}
+	if err := syscall.Kill(child.Pid, 0); err != syscall.ESRCH {
+		test.Error("daemon was not killed:", err)
+	}
+}
+
+// reexecEnvName is the environment variable, which tells the helper
+// "reexec" what copy of the daemon-process it is.
+const reexecEnvName = "_GO_DAEMON_TEST_REEXEC"
+
+func TestReExec(test *testing.T) {
+	if err := new(Context).ReExec(); err == nil {
+		test.Fatal("ReExec() in parent: error was not detected")
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer file.Close()
+
+	dmn := newTestContext(test, "reexec")
+	dmn.ExtraFiles = []*os.File{file}
+	child, err := dmn.Reborn()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = dmn.WaitReady(5 * time.Second); err != nil {
+		child.Kill()
+		child.Wait()
+		test.Fatal(err)
+	}
+	// the old daemon-process exits once the new copy is ready
+	state, err := child.Wait()
+	if err != nil || !state.Success() {
+		data, _ := ioutil.ReadFile(dmn.LogFileName)
+		test.Fatalf("old daemon-process: %v, %v, log: %q", state, err, data)
+	}
+
+	pid, held, err := ProbePidFile(dmn.PidFileName)
+	if err != nil || !held || pid == child.Pid {
+		test.Fatal("pid file of new copy:", pid, held, err)
+	}
+	defer func() {
+		if err := dmn.StopE(); err != nil {
+			test.Error(err)
+		}
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	var served int
+	if _, err = fmt.Fscanln(conn, &served); err != nil || served != pid {
+		test.Fatal("socket is served by", served, err)
+	}
+	if data, _ := ioutil.ReadFile(dmn.LogFileName); !strings.Contains(string(data), "reexec: fail\n") {
+		test.Fatalf("log of failed copy: %q", data)
+	}
+}
+
+func TestWaitReadyExited(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	startHelper(test, dmn)
+	if err := dmn.WaitReady(5 * time.Second); !errors.Is(err, ErrNotReady) ||
+		!strings.HasSuffix(err.Error(), ": exit status 0") {
+		test.Fatal("WaitReady():", err)
+	}
+
+	// the exit status tells why the daemon failed
+	dmn = newTestContext(test, "exit")
+	startHelper(test, dmn)
+	if err := dmn.WaitReady(5 * time.Second); !errors.Is(err, ErrNotReady) ||
+		!strings.HasSuffix(err.Error(), ": exit status 3") {
+		test.Fatal("WaitReady():", err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+
+	// the daemon-process is not a child
+	dmn = newTestContext(test, "streams")
+	dmn.DoubleFork = true
+	startHelper(test, dmn)
+	if err := dmn.WaitReady(5 * time.Second); err != ErrNotReady {
+		test.Fatal("WaitReady() with DoubleFork:", err)
+	}
+}
+
+func TestReadReady(test *testing.T) {
+	if err := readReady(strings.NewReader("READY=1\n")); err != nil {
+		test.Error("readReady(READY=1):", err)
+	}
+	if err := readReady(strings.NewReader("ERROR=failed\n")); !errors.Is(err, ErrNotReady) ||
+		!strings.HasSuffix(err.Error(), ": failed") {
+		test.Error("readReady(ERROR):", err)
+	}
+	if err := readReady(strings.NewReader("READY=1")); err != ErrNotReady {
+		test.Error("readReady() of closed pipe:", err)
+	}
+	for _, line := range []string{"READY=0\n", "READY=10\n", "STATUS=ok\n"} {
+		if err := readReady(strings.NewReader(line)); err == nil || errors.Is(err, ErrNotReady) {
+			test.Errorf("readReady(%q): %v", line, err)
+		}
+	}
+}
+
+func TestDecodeConfig(test *testing.T) {
+	dmn := &Context{PidFileName: "/run/app.pid", Args: []string{"app"}, Env: []string{"A=1"}}
+	data, err := json.Marshal(config{Context: dmn, ExtraFilesNum: 2})
+	if err != nil {
+		test.Fatal(err)
+	}
+	conf, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		test.Fatal(err)
+	}
+	if conf.PidFileName != dmn.PidFileName || conf.ExtraFilesNum != 2 {
+		test.Fatalf("decodeConfig(): %+v", conf)
+	}
+
+	// parent crashed while sending the context
+	for n := 0; n < len(data); n++ {
+		if _, err = decodeConfig(bytes.NewReader(data[:n])); err == nil {
+			test.Fatalf("decodeConfig(%q): Error was not detected", data[:n])
+		}
+	}
+	if _, err = decodeConfig(strings.NewReader("")); !errors.Is(err, io.EOF) {
+		test.Error("decodeConfig() of empty input:", err)
+	}
+	if _, err = decodeConfig(strings.NewReader("{}")); err != errIncompleteContext {
+		test.Error("decodeConfig() of empty context:", err)
+	}
+	if _, err = decodeConfig(strings.NewReader(`{"Args":["app"],"Env":["A=1"],"ExtraFilesNum":-1}`)); err != errIncompleteContext {
+		test.Error("decodeConfig() of negative ExtraFilesNum:", err)
+	}
+}
+
+func TestContextRoundTrip(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		test.Fatal(err)
+	}
+
+	dmn := newTestContext(test, "context")
+	dmn.PidFilePerm = 0600 | os.ModeSetgid
+	dmn.LogFilePerm = 0604
+	dmn.LogFileFlag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	dmn.StderrFilePerm = 0620
+	dmn.WorkDir = filepath.Dir(dmn.LogFileName)
+	dmn.Chroot = "/"
+	dmn.MarkName = "_GO_DAEMON_ROUND_TRIP"
+	dmn.MarkValue = "yes"
+	// the helper is run for the default mark, see TestMain
+	dmn.Env = append(dmn.Env, MARK_NAME+"="+MARK_VALUE)
+	dmn.Credential = &syscall.Credential{Uid: 0, Gid: 0, Groups: []uint32{0}, NoSetGroups: true}
+	dmn.InitGroups = true
+	dmn.Umask = 027
+	dmn.SetUmask = true
+	dmn.Rlimits = map[int]syscall.Rlimit{syscall.RLIMIT_NOFILE: rlimit}
+	dmn.CloseFDs = true
+	dmn.CPUAffinity = []int{0}
+	dmn.Nice = 1
+	oomScoreAdj := 100
+	dmn.OOMScoreAdj = &oomScoreAdj
+	dmn.DoubleFork = true
+	dmn.NoSetsid = true
+	dmn.Setpgid = true
+	dmn.Cloneflags = 0x4000000 // CLONE_NEWUTS on Linux
+	dmn.Capabilities = []uintptr{10}
+	dmn.DropAtExec = true
+	dmn.ChownFiles = true
+	dmn.ExecPath = os.Args[0]
+	dmn.Subcommand = "start"
+	dmn.SyslogTag = "tag"
+	dmn.SyslogFacility = syslog.LOG_LOCAL3
+	dmn.SyslogNetwork = "udp"
+	dmn.SyslogAddr = "localhost:514"
+	dmn.PidFileLabel = "/pid"
+	dmn.ProcessName = "app"
+	dmn.PidFileInfo = map[string]string{"version": "1.0"}
+	dmn.PidFileHost = true
+	dmn.LockRetries = 1
+	dmn.LockRetryInterval = time.Millisecond
+	dmn.LockDir = true
+	dmn.ExecName = "app"
+	dmn.StopSignal = syscall.SIGINT
+	dmn.StopTimeout = time.Second
+	dmn.RestartTimeout = time.Minute
+	dmn.StopOnSignal = true
+	dmn.QueueSignals = true
+	dmn.ExtraFiles = []*os.File{os.Stdout}
+	dmn.StdinFile = os.Stdin
+	dmn.SocketHandshake = true
+	dmn.Out = os.Stdout
+	dmn.OnFork = func(*os.Process) error { return nil }
+	dmn.OnStop = func(context.Context) {}
+	dmn.OnPrivileged = func() error { return nil }
+	dmn.EnvFilter = func(string, string) bool { return true }
+	dmn.Logger = writerLogger{ioutil.Discard}
+
+	// options, which change output of the daemon-process or exclude
+	// the set ones, are left out
+	skip := map[string]bool{"StderrFileName": true, "UseSyslog": true, "ClearGroups": true,
+		"NewPIDNamespace": true, "Foreground": true, "LogWriter": true, "KeepStdStreams": true}
+	v := reflect.ValueOf(dmn).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath == "" && !skip[f.Name] && v.Field(i).IsZero() {
+			test.Errorf("field %s is not set", f.Name)
+		}
+	}
+
+	startHelper(test, dmn)
+	expected, err := json.Marshal(dmn)
+	if err != nil {
+		test.Fatal(err)
+	}
+	waitLog(test, dmn, string(expected)+"\n")
+}
+
+// writerLogger writes the messages of Logger as lines into a writer.
+type writerLogger struct {
+	w io.Writer
+}
+
+func (l writerLogger) Debugf(format string, args ...interface{}) {
+	fmt.Fprintf(l.w, "debug: "+format+"\n", args...)
+}
+
+func (l writerLogger) Errorf(format string, args ...interface{}) {
+	fmt.Fprintf(l.w, "error: "+format+"\n", args...)
+}
+
+// checkMessages fails, unless text contains the messages in given order.
+func checkMessages(test *testing.T, text string, messages ...string) {
+	rest := text
+	for _, msg := range messages {
+		i := strings.Index(rest, msg)
+		if i < 0 {
+			test.Fatalf("message %q is missing in order in %q", msg, text)
+		}
+		rest = rest[i+len(msg):]
+	}
+}
+
+func TestLogger(test *testing.T) {
+	dmn := newTestContext(test, "logger")
+	messages := new(syncBuffer)
+	dmn.Logger = writerLogger{messages}
+	child := startHelper(test, dmn)
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("daemon failed:", state, err)
+	}
+	checkMessages(test, messages.String(),
+		"debug: locked pid file "+dmn.PidFileName+"\n",
+		"debug: starting daemon-process ",
+		fmt.Sprintf("debug: started daemon-process %d\n", child.Pid),
+		fmt.Sprintf("debug: sent context to daemon-process %d\n", child.Pid))
+
+	// the daemon-process logs by its own Logger
+	data, err := ioutil.ReadFile(dmn.LogFileName)
+	if err != nil {
+		test.Fatal(err)
+	}
+	checkMessages(test, string(data),
+		"debug: read context of parent with 0 extra files\n",
+		"debug: wrote pid file "+dmn.PidFileName+"\n",
+		"debug: daemon-process is initialized\n")
+
+	dmn.Setpgid = true
+	if _, err = dmn.Reborn(); err != errSetpgid {
+		test.Fatal("Reborn(): expected errSetpgid, got", err)
+	}
+	checkMessages(test, messages.String(), "error: start daemon-process: "+errSetpgid.Error()+"\n")
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestLogWriter(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	out := new(syncBuffer)
+	dmn.LogWriter = out
+	if _, err := dmn.Reborn(); err != errLogWriter {
+		test.Fatal("Reborn(): expected errLogWriter, got", err)
+	}
+
+	dmn.LogFileName = ""
+	startHelper(test, dmn)
+	if state, err := dmn.Wait(); err != nil || !state.Success() {
+		test.Fatal("Wait():", state, err)
+	}
+	// Wait returns once the output is copied
+	if s := out.String(); s != "stdout\nstderr\n" {
+		test.Fatalf("output of daemon: %q", s)
+	}
+}
+
+func TestKeepStdStreams(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	dmn.KeepStdStreams = true
+	if _, err := dmn.Reborn(); err != errKeepStdStreams {
+		test.Fatal("Reborn(): expected errKeepStdStreams, got", err)
+	}
+	dmn.LogFileName = ""
+	out, stdout, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer out.Close()
+
+	saved := []*os.File{os.Stdout, os.Stderr}
+	os.Stdout, os.Stderr = stdout, stdout
+	child, err := dmn.Reborn()
+	os.Stdout, os.Stderr = saved[0], saved[1]
+	stdout.Close()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer child.Wait()
+
+	data, err := ioutil.ReadAll(out)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(data) != "stdout\nstderr\n" {
+		test.Fatalf("output of daemon: %q", data)
+	}
+}
+
+func TestForeground(test *testing.T) {
+	dmn := newTestContext(test, "foreground")
+	dmn.Foreground = true
+	dmn.DoubleFork = true
+	stdin, in, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer in.Close()
+	out, stdout, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer out.Close()
+
+	// the daemon-process gets the std streams of parent
+	saved := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	os.Stdin, os.Stdout, os.Stderr = stdin, stdout, stdout
+	child, err := dmn.Reborn()
+	os.Stdin, os.Stdout, os.Stderr = saved[0], saved[1], saved[2]
+	stdin.Close()
+	stdout.Close()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer child.Kill()
+
+	fmt.Fprintln(in, "hello")
+	data, err := ioutil.ReadAll(out)
+	if err != nil {
+		test.Fatal(err)
+	}
+	// the daemon-process stays in the process group and is a child
+	if expected := fmt.Sprintf("hello\n%d\n", syscall.Getpgrp()); string(data) != expected {
+		test.Fatalf("output of daemon: %q, expected %q", data, expected)
+	}
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("Wait():", state, err)
+	}
+	if _, err = os.Stat(dmn.LogFileName); !os.IsNotExist(err) {
+		test.Fatal("log file was created:", err)
+	}
+}
+
+func TestLogFileFlag(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	dmn.LogFileFlag = os.O_CREATE
+	if _, err := dmn.Reborn(); err != errLogFileFlag {
+		test.Fatal("Reborn(): expected errLogFileFlag, got", err)
+	}
+
+	dmn.LogFileFlag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	for i := 0; i < 2; i++ {
+		startHelper(test, dmn)
+		if _, err := dmn.Wait(); err != nil {
+			test.Fatal(err)
+		}
+	}
+	// the log has only the output of the last run
+	waitLog(test, dmn, "stdout\nstderr\n")
+}
+
+func TestStdinFile(test *testing.T) {
+	dmn := newTestContext(test, "stdin")
+	r, w, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer w.Close()
+	dmn.StdinFile = r
+	child := startHelper(test, dmn)
+	r.Close()
+	defer child.Wait()
+
+	fmt.Fprintln(w, "hello")
+	waitLog(test, dmn, "hello\n")
+}
+
+func TestSocketHandshake(test *testing.T) {
+	dmn := newTestContext(test, "handshake")
+	dmn.SocketHandshake = true
+	// the context does not fit into the socket buffer
+	big := strings.Repeat("x", 100000)
+	dmn.Env = append(dmn.Env, "BIG1="+big, "BIG2="+big, "BIG3="+big, "BIG4="+big)
+	stdin, w, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer stdin.Close()
+	fmt.Fprintln(w, "hello")
+	w.Close()
+	dmn.StdinFile = stdin
+	r, extra, err := os.Pipe()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer r.Close()
+	dmn.ExtraFiles = []*os.File{extra}
+
+	child, err := dmn.Reborn()
+	extra.Close()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer child.Wait()
+	if err = dmn.WaitReady(5 * time.Second); err != nil {
+		test.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(data) != "extra\n" {
+		test.Fatalf("received from daemon: %q", data)
+	}
+	// the variable of the handshake is not left to the daemon-process
+	waitLog(test, dmn, "hello\n\n")
+}
+
+func TestListenFiles(test *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer ln.Close()
+	file, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer file.Close()
+
+	dmn := newTestContext(test, "listen")
+	cmd := exec.Command(os.Args[0])
+	// the socket becomes descriptor 3 as with systemd
+	cmd.ExtraFiles = []*os.File{file}
+	cmd.Env = append(dmn.Env, activatedEnvName+"="+dmn.LogFileName,
+		listenFdsEnvName+"=1", listenNamesEnvName+"=web")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		test.Fatalf("%v: %s", err, out)
+	}
+	file.Close()
+	ln.Close()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		test.Fatal(err)
+	}
+	// the variables of socket activation are not left to the daemon-process
+	if string(data) != "web \"\"\n" {
+		test.Fatalf("received from daemon: %q", data)
+	}
+}
+
+func TestStartForeground(test *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	uid := os.Getuid()
+	if uid == 0 {
+		// nobody removes the pid file
+		uid = 65534
+		if err = os.Chmod(dir, 0777); err != nil {
+			test.Fatal(err)
+		}
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		test.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), foregroundEnvName+"="+dir)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		test.Fatalf("%v: %s", err, stderr.Bytes())
+	}
+	// main runs in the started process itself, which is in the pid file
+	pid := cmd.Process.Pid
+	if want := fmt.Sprintf("%d %d <nil> %d 27 %s\n", pid, pid, uid, dir); stdout.String() != want {
+		test.Fatalf("foreground printed %q, want %q", stdout.Bytes(), want)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "pid")); !os.IsNotExist(err) {
+		test.Fatal("pid file is not removed:", err)
+	}
+}
+
+func TestLargeContext(test *testing.T) {
+	dmn := newTestContext(test, "envsize")
+	// the context is several times larger than the pipe buffer
+	big := strings.Repeat("x", 100000)
+	for i := 0; i < 4; i++ {
+		dmn.Env = append(dmn.Env, fmt.Sprintf("BIG%d=%s", i, big))
+	}
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, fmt.Sprintln(len(strings.Join(dmn.Env, "\n"))))
+}
+
+func TestRebornContext(test *testing.T) {
+	dmn := newTestContext(test, "stuck")
+	// the context does not fit into the pipe buffer
+	big := strings.Repeat("x", 100000)
+	dmn.Env = append(dmn.Env, "BIG1="+big, "BIG2="+big)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := dmn.RebornContext(ctx)
+	if err != context.DeadlineExceeded {
+		test.Fatal("RebornContext():", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		test.Error("RebornContext() returned after", elapsed)
+	}
+	if err = syscall.Kill(dmn.ChildPid(), 0); err != syscall.ESRCH {
+		test.Error("daemon was not killed:", err)
+	}
+	if _, err = os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Error("pid file was not removed:", err)
+	}
+
+	if _, err = dmn.RebornContext(ctx); err != context.DeadlineExceeded {
+		test.Error("RebornContext() with done context:", err)
+	}
+}
+
+func TestLogFile(test *testing.T) {
+	dmn := newTestContext(test, "logfile")
+	if f := dmn.LogFile(); f != nil {
+		test.Fatal("LogFile() in parent:", f.Name())
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	waitLog(test, dmn, "logfile\ntrue\n")
+}
+
+func TestChildInitFailure(test *testing.T) {
+	dmn := newTestContext(test, "ids")
+	dmn.Chroot = "/nonexistent"
+	if _, err := dmn.Reborn(); err != nil {
+		test.Fatal(err)
+	}
+	err := dmn.WaitReady(5 * time.Second)
+	if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), `chroot("/nonexistent"): no such file`) {
+		test.Fatal("WaitReady():", err)
+	}
+	// the failed daemon-process is reaped by WaitReady
+	if state, err := dmn.Wait(); err == nil {
+		test.Fatal("Wait(): failed daemon-process was not reaped:", state)
+	}
+	if _, err = os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+	// the daemon does not run outside of the new root
+	if data, err := ioutil.ReadFile(dmn.LogFileName); err != nil || strings.Contains(string(data), "0 0") {
+		test.Fatalf("log of daemon: %q, %v", data, err)
+	}
+
+	next := newTestContext(test, "serve")
+	next.PidFileName = dmn.PidFileName
+	p, err := next.StartE()
+	if err != nil {
+		test.Fatal("StartE() after failure:", err)
+	}
+	defer p.Wait()
+	defer p.Kill()
+}
+
+func TestInitGroups(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	for _, initGroups := range []bool{false, true} {
+		dmn := newTestContext(test, "groups")
+		dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		dmn.InitGroups = initGroups
+		child := startHelper(test, dmn)
+		child.Wait()
+
+		expected, err := statusLine("Groups")
+		if err != nil {
+			test.Fatal(err)
+		}
+		if initGroups {
+			ids, err := u.GroupIds()
+			if err != nil {
+				test.Fatal(err)
+			}
+			expected = "Groups:\t" + u.Gid
+			for _, id := range ids {
+				if id != u.Gid {
+					expected += " " + id
+				}
+			}
+		}
+		waitLog(test, dmn, expected+"\n")
+	}
+}
+
+func TestRun(test *testing.T) {
+	for _, stopOnSignal := range []bool{false, true} {
+		dmn := newTestContext(test, "run")
+		dmn.StopOnSignal = stopOnSignal
+		child, err := dmn.Reborn()
+		if err != nil {
+			test.Fatal(err)
+		}
+		waitLog(test, dmn, "run\n")
+		if stopOnSignal {
+			child.Signal(syscall.SIGTERM)
+		}
+		if state, err := child.Wait(); err != nil || !state.Success() {
+			test.Fatal("Wait():", state, err)
+		}
+		if _, err = os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+			test.Fatal("pid file was not removed:", err)
+		}
+	}
+}
+
+func TestOnPrivileged(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	dmn := newTestContext(test, "privileged")
+	dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, fmt.Sprintln(true, uid))
+
+	dmn = newTestContext(test, "privileged")
+	dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	dmn.Env = append(dmn.Env, hookErrorEnvName+"=1")
+	if _, err = dmn.Reborn(); err != nil {
+		test.Fatal(err)
+	}
+	err = dmn.WaitReady(5 * time.Second)
+	if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), "OnPrivileged: hook failed") {
+		test.Fatal("WaitReady():", err)
+	}
+	dmn.Wait()
+	if _, err = os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed:", err)
+	}
+}
+
+func TestChownFiles(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	dmn.ChownFiles = true
+	if _, err := dmn.Reborn(); err != errChownFiles {
+		test.Fatal("Reborn(): expected errChownFiles, got", err)
+	}
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	dmn.StderrFileName = filepath.Join(filepath.Dir(dmn.PidFileName), "err")
+	dir := filepath.Dir(dmn.PidFileName)
+	if err = os.Chmod(dir, 0755); err != nil {
+		test.Fatal(err)
+	}
+	dmn.ExecPath = copyExec(test, dir)
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+	for _, name := range []string{dmn.PidFileName, dmn.LogFileName, dmn.StderrFileName} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != uid || int(st.Gid) != gid {
+			test.Errorf("owner of %s: %d:%d", filepath.Base(name), st.Uid, st.Gid)
+		}
+	}
+
+	// the pid file owned by the user is not of another user
+	if err = dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	child.Wait()
+	if err = ioutil.WriteFile(dmn.PidFileName, []byte(fmt.Sprintln(child.Pid)), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	if err = os.Chown(dmn.PidFileName, uid, gid); err != nil {
+		test.Fatal(err)
+	}
+	child = startHelper(test, dmn)
+}
+
+func TestDropAtExec(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	for _, c := range []struct{ uid, gid int }{{uid, gid}, {0, 0}} {
+		for _, atExec := range []bool{false, true} {
+			dmn := newTestContext(test, "ids")
+			dmn.Credential = &syscall.Credential{Uid: uint32(c.uid), Gid: uint32(c.gid)}
+			dmn.DropAtExec = atExec
+			// the user executes the binary itself
+			dir := filepath.Dir(dmn.PidFileName)
+			if err = os.Chmod(dir, 0755); err != nil {
+				test.Fatal(err)
+			}
+			dmn.ExecPath = copyExec(test, dir)
+			child := startHelper(test, dmn)
+			child.Wait()
+			waitLog(test, dmn, fmt.Sprintln(c.uid, c.gid))
+		}
+	}
+
+	// the setup has no privileges
+	dmn := newTestContext(test, "privileged")
+	dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	dmn.DropAtExec = true
+	dir := filepath.Dir(dmn.PidFileName)
+	if err = os.Chmod(dir, 0755); err != nil {
+		test.Fatal(err)
+	}
+	dmn.ExecPath = copyExec(test, dir)
+	if _, err = dmn.Reborn(); err != nil {
+		test.Fatal(err)
+	}
+	err = dmn.WaitReady(5 * time.Second)
+	if !errors.Is(err, ErrNotReady) || !strings.Contains(err.Error(), "OnPrivileged:") {
+		test.Fatal("WaitReady():", err)
+	}
+	dmn.Wait()
+
+	dmn = newTestContext(test, "ids")
+	dmn.DropAtExec = true
+	if _, err = dmn.Reborn(); err != errDropAtExec {
+		test.Fatal("Reborn(): expected errDropAtExec, got", err)
+	}
+}
+
+func TestZeroCredential(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	// the real ids of parent are not root, so keeping them differs
+	// from setting zero ones
+	if err = syscall.Setregid(gid, 0); err != nil {
+		test.Fatal(err)
+	}
+	defer syscall.Setregid(0, 0)
+	if err = syscall.Setreuid(uid, 0); err != nil {
+		test.Fatal(err)
+	}
+	defer syscall.Setreuid(0, 0)
+
+	for _, c := range []struct {
+		cred *syscall.Credential
+		ids  string
+	}{
+		{nil, fmt.Sprintln(uid, gid)},
+		{&syscall.Credential{Uid: 0, Gid: 0}, "0 0\n"},
+	} {
+		dmn := newTestContext(test, "ids")
+		dmn.Credential = c.cred
+		child := startHelper(test, dmn)
+		child.Wait()
+		waitLog(test, dmn, c.ids)
+	}
+}
+
+func TestClearGroups(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	dmn := newTestContext(test, "groups")
+	dmn.InitGroups = true
+	dmn.ClearGroups = true
+	if _, err := dmn.Reborn(); err != errGroups {
+		test.Fatal("Reborn(): expected errGroups, got", err)
+	}
+
+	dmn.InitGroups = false
+	dmn.Credential = &syscall.Credential{Uid: 1, Gid: 1}
+	// the test process gets a supplementary group which is inherited
+	// by the daemon unless it is cleared
+	groups, err := syscall.Getgroups()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if err = syscall.Setgroups(append(groups, 4242)); err != nil {
+		test.Fatal(err)
+	}
+	defer syscall.Setgroups(groups)
+
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "Groups:\n")
+}
+
+func TestSetUmask(test *testing.T) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+
+	perms := map[bool]os.FileMode{false: 0644, true: 0666}
+	for setUmask, perm := range perms {
+		dmn := newTestContext(test, "umask")
+		dmn.SetUmask = setUmask
+		child := startHelper(test, dmn)
+		child.Wait()
+		waitLog(test, dmn, fmt.Sprintln(perm))
+	}
+}
+
+func TestRlimits(test *testing.T) {
+	dmn := newTestContext(test, "rlimit")
+	dmn.Rlimits = map[int]syscall.Rlimit{
+		syscall.RLIMIT_NOFILE: {Cur: 100, Max: 200},
+	}
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "100 200\n")
+
+	dmn = newTestContext(test, "rlimit")
+	dmn.Rlimits = map[int]syscall.Rlimit{
+		syscall.RLIMIT_NOFILE: {Cur: 200, Max: 100},
+	}
+	child, err := dmn.Reborn()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if state, _ := child.Wait(); state.Success() {
+		test.Fatal("daemon was started with invalid limits")
+	}
+	if data, _ := ioutil.ReadFile(dmn.LogFileName); !strings.Contains(string(data), "setrlimit") {
+		test.Fatalf("log content: %q", data)
+	}
+}
+
+func TestSched(test *testing.T) {
+	if runtime.GOOS != "linux" {
+		test.Skip("CPUAffinity is supported on Linux only")
+	}
+	dmn := newTestContext(test, "sched")
+	dmn.CPUAffinity = []int{0}
+	dmn.Nice = 7
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "Cpus_allowed_list:\t0 7 true\n")
+
+	dmn = newTestContext(test, "sched")
+	dmn.CPUAffinity = []int{-1}
+	if _, err := dmn.Reborn(); err != nil {
+		test.Fatal(err)
+	}
+	if err := dmn.WaitReady(5 * time.Second); err == nil || !strings.Contains(err.Error(), "sched_setaffinity") {
+		test.Fatal("WaitReady(): expected error of sched_setaffinity, got", err)
+	}
+	dmn.Wait()
+}
+
+func TestOOMScoreAdj(test *testing.T) {
+	if runtime.GOOS != "linux" {
+		test.Skip("OOMScoreAdj is supported on Linux only")
+	}
+	dmn := newTestContext(test, "oom")
+	adj := 500
+	dmn.OOMScoreAdj = &adj
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "500\n")
+
+	for _, adj := range []int{-1001, 1001} {
+		dmn = newTestContext(test, "oom")
+		dmn.OOMScoreAdj = &adj
+		if _, err := dmn.Reborn(); err != errOOMScoreAdj {
+			test.Errorf("Reborn() for %d: expected errOOMScoreAdj, got %v", adj, err)
+		}
+	}
+}
+
+func TestChrootWorkDir(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	dmn := newTestContext(test, "serve")
+	root := filepath.Dir(dmn.PidFileName)
+	if err := os.Mkdir(filepath.Join(root, "work"), 0755); err != nil {
+		test.Fatal(err)
+	}
+	dmn.Chroot = root
+	dmn.WorkDir = "/work"
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer child.Kill()
+
+	cwd := fmt.Sprintf("/proc/%d/cwd", child.Pid)
+	for i := 0; ; i++ {
+		dir, err := os.Readlink(cwd)
+		if err == nil && dir == filepath.Join(root, "work") {
+			break
+		} else if i == 100 {
+			test.Fatal("working directory of daemon:", dir, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestChrootRelease(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	if runtime.GOOS != "linux" {
+		test.Skip("the pid file outside of the new root is removed on Linux only")
+	}
+	dmn := newTestContext(test, "serve")
+	// the pid file is outside of the new root
+	dmn.Chroot = filepath.Join(filepath.Dir(dmn.PidFileName), "jail")
+	if err := os.Mkdir(dmn.Chroot, 0755); err != nil {
+		test.Fatal(err)
+	}
+	child := startHelper(test, dmn)
+	if err := child.Signal(syscall.SIGTERM); err != nil {
+		test.Fatal(err)
+	}
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("daemon was not stopped gracefully:", state, err)
+	}
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not removed by Release:", err)
+	}
+}
+
+func TestNewPIDNamespace(test *testing.T) {
+	if runtime.GOOS != "linux" {
+		test.Skip("NewPIDNamespace is supported on Linux only")
+	}
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	dmn := newTestContext(test, "pid")
+	dmn.NewPIDNamespace = true
+	// pid file holds the pid outside of the namespace
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	waitLog(test, dmn, "1\n")
+
+	if p, err := dmn.Search(); err != nil || p.Pid != child.Pid {
+		test.Fatal("Search():", p, err)
+	}
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+
+	dmn = newTestContext(test, "pid")
+	dmn.NewPIDNamespace = true
+	dmn.DoubleFork = true
+	if _, err := dmn.Reborn(); err != errPIDNamespace {
+		test.Fatal("Reborn(): expected errPIDNamespace, got", err)
+	}
+}
+
+func TestProcessName(test *testing.T) {
+	if runtime.GOOS != "linux" {
+		test.Skip("command name is set on Linux only")
+	}
+	for _, double := range []bool{false, true} {
+		dmn := newTestContext(test, "name")
+		dmn.ProcessName = "go-daemon-test-process"
+		dmn.DoubleFork = double
+		startHelper(test, dmn)
+		waitLog(test, dmn, "go-daemon-test-process go-daemon-test-\n")
+	}
+}
+
+func TestChildLocksPidFile(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+
+	// parent has released its descriptor, the daemon-process holds the lock
+	lock, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Close()
+	if err = lock.TryLock(); err != ErrWouldBlock {
+		test.Fatal("TryLock(): expected ErrWouldBlock, got", err)
+	}
+}
+
+func TestPidFileLabel(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	dmn := newTestContext(test, "pidlabel")
+	dmn.Chroot = filepath.Dir(dmn.PidFileName)
+	dmn.PidFileLabel = "/pid"
+	child := startHelper(test, dmn)
+	child.Wait()
+
+	waitLog(test, dmn, "/pid true\n")
+	// the daemon-process releases pid file without /proc by the label
+	if _, err := os.Stat(dmn.PidFileName); !os.IsNotExist(err) {
+		test.Fatal("pid file was not released:", err)
+	}
+}
+
+func TestCloseFDs(test *testing.T) {
+	for _, closeFDs := range []bool{false, true} {
+		dmn := newTestContext(test, "fds")
+		dmn.CloseFDs = closeFDs
+
+		// the file is inherited by the daemon-process by mistake,
+		// dup2 clears close-on-exec flag
+		name := filepath.Join(filepath.Dir(dmn.LogFileName), "leak")
+		leak, err := os.Create(name)
+		if err != nil {
+			test.Fatal(err)
+		}
+		err = syscall.Dup2(int(leak.Fd()), 100)
+		leak.Close()
+		if err != nil {
+			test.Fatal(err)
+		}
+		child := startHelper(test, dmn)
+		syscall.Close(100)
+		child.Wait()
+
+		data, err := ioutil.ReadFile(dmn.LogFileName)
+		if err != nil {
+			test.Fatal(err)
+		}
+		if inherited := strings.Contains(string(data), name); inherited == closeFDs {
+			test.Errorf("CloseFDs: %v, file inherited: %v", closeFDs, inherited)
+		}
+		if !strings.Contains(string(data), dmn.PidFileName) {
+			test.Errorf("CloseFDs: %v, pid file is closed", closeFDs)
+		}
+	}
+}
+
+// getsid returns session id of the process.
+func getsid() int {
+	sid, _, _ := syscall.RawSyscall(syscall.SYS_GETSID, 0, 0, 0)
+	return int(sid)
+}
+
+func TestSessionLeader(test *testing.T) {
+	dmn := newTestContext(test, "leader")
+	startErr := &os.PathError{Op: "fork/exec", Path: os.Args[0], Err: syscall.EPERM}
+	if err := dmn.setsidError(startErr, &syscall.SysProcAttr{Setsid: true}); !errors.Is(err, ErrSetsid) {
+		test.Fatal("EPERM of new session is not ErrSetsid:", err)
+	}
+	if err := dmn.setsidError(startErr, &syscall.SysProcAttr{}); err != startErr {
+		test.Fatal("EPERM without new session:", err)
+	}
+	dmn.Cloneflags = 0x4000000 // CLONE_NEWUTS on Linux
+	if err := dmn.setsidError(startErr, &syscall.SysProcAttr{Setsid: true}); err != startErr {
+		test.Fatal("EPERM of new namespace:", err)
+	}
+	dmn.Cloneflags = 0
+
+	// the daemon-process is the session leader, which starts another daemon
+	child := startHelper(test, dmn)
+	if state, err := child.Wait(); err != nil || !state.Success() {
+		test.Fatal("leader:", state, err)
+	}
+	data, err := ioutil.ReadFile(dmn.LogFileName)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if string(data) == "setsid\n" {
+		test.Skip("the kernel refuses new session to the child of session leader")
+	}
+	var pid, sid, pgid int
+	if _, err = fmt.Sscan(string(data), &sid, &pgid, &pid); err != nil {
+		test.Fatalf("output of leader: %q", data)
+	}
+	if sid != pid || pgid != pid {
+		test.Fatal("daemon of session leader did not start a new session:", pid, sid, pgid)
+	}
+}
+
+func TestNoSetsid(test *testing.T) {
+	dmn := newTestContext(test, "session")
+	dmn.Setpgid = true
+	if _, err := dmn.Reborn(); err != errSetpgid {
+		test.Fatal("Reborn(): expected errSetpgid, got", err)
+	}
+
+	cases := []struct{ noSetsid, setpgid bool }{{false, false}, {true, false}, {true, true}}
+	for _, c := range cases {
+		dmn := newTestContext(test, "session")
+		dmn.NoSetsid = c.noSetsid
+		dmn.Setpgid = c.setpgid
+		child := startHelper(test, dmn)
+		child.Wait()
+
+		sid, pgid := child.Pid, child.Pid
+		if c.noSetsid {
+			sid = getsid()
+			if !c.setpgid {
+				pgid = syscall.Getpgrp()
+			}
+		}
+		waitLog(test, dmn, fmt.Sprintln(sid, pgid))
+	}
+}
+
+func TestExtraFiles(test *testing.T) {
+	for _, pidFileName := range []string{"pid", ""} {
+		dmn := newTestContext(test, "extra")
+		if pidFileName == "" {
+			dmn.PidFileName = ""
+		}
+		r, w, err := os.Pipe()
+		if err != nil {
+			test.Fatal(err)
+		}
+		dmn.ExtraFiles = []*os.File{w}
+		child, err := dmn.Reborn()
+		w.Close()
+		if err != nil {
+			test.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		child.Wait()
+		if err != nil {
+			test.Fatal(err)
+		}
+		if string(data) != "extra\n" {
+			test.Fatalf("received from daemon: %q", data)
+		}
+	}
+}
+
+func TestStderrFileName(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	dmn.StderrFileName = filepath.Join(filepath.Dir(dmn.LogFileName), "err")
+	child := startHelper(test, dmn)
+	child.Wait()
+
+	waitLog(test, dmn, "stdout\n")
+	if data, err := ioutil.ReadFile(dmn.StderrFileName); err != nil || string(data) != "stderr\n" {
+		test.Fatalf("stderr content: %q, %v", data, err)
+	}
+
+	// both streams are written into the log file by default
+	dmn = newTestContext(test, "streams")
+	child = startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "stdout\nstderr\n")
+}
+
+func TestUseSyslog(test *testing.T) {
+	dmn := newTestContext(test, "streams")
+	dmn.UseSyslog = true
+	if _, err := dmn.Reborn(); err != errSyslog {
+		test.Fatal("Reborn(): expected errSyslog, got", err)
+	}
+
+	addr := filepath.Join(filepath.Dir(dmn.LogFileName), "syslog")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer conn.Close()
+
+	dmn.LogFileName = ""
+	dmn.SyslogNetwork = "unixgram"
+	dmn.SyslogAddr = addr
+	dmn.SyslogTag = "daemon-test"
+	child := startHelper(test, dmn)
+	child.Wait()
+
+	buf := make([]byte, 1024)
+	for _, text := range []string{"stdout", "stderr"} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			test.Fatal(err)
+		}
+		msg := string(buf[:n])
+		// <30> is LOG_DAEMON|LOG_INFO
+		if !strings.HasPrefix(msg, "<30>") || !strings.Contains(msg, "daemon-test") ||
+			!strings.HasSuffix(msg, ": "+text+"\n") {
+			test.Fatalf("syslog message: %q", msg)
+		}
+	}
+	// the forwarder exits with the daemon and is reaped by parent
+	pid := dmn.forwarder.Pid
+	dmn.Release()
+	if dmn.forwarder != nil {
+		test.Fatal("syslog forwarder was not reaped")
+	}
+	if err := syscall.Kill(pid, 0); err != syscall.ESRCH {
+		test.Fatal("syslog forwarder is running:", err)
+	}
+}
+
+func TestReopenLog(test *testing.T) {
+	dmn := newTestContext(test, "rotate")
+	// signals stay ignored in the daemon until it starts serving signals
+	signal.Ignore(syscall.SIGHUP, syscall.SIGUSR1)
+	child := startHelper(test, dmn)
+	signal.Reset(syscall.SIGHUP, syscall.SIGUSR1)
+	defer child.Wait()
+	defer child.Kill()
+
+	waitLog(test, dmn, "before\n")
+	rotated := dmn.LogFileName + ".1"
+	if err := os.Rename(dmn.LogFileName, rotated); err != nil {
+		test.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if err := child.Signal(syscall.SIGUSR1); err != nil {
+			test.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+		if _, err := os.Stat(dmn.LogFileName); err == nil {
+			break
+		} else if i == 100 {
+			test.Fatal("log file was not reopened")
+		}
+	}
+	if err := child.Signal(syscall.SIGHUP); err != nil {
+		test.Fatal(err)
+	}
+	waitLog(test, dmn, "after\n")
+
+	if data, err := ioutil.ReadFile(rotated); err != nil || string(data) != "before\n" {
+		test.Fatalf("rotated log content: %q, %v", data, err)
+	}
+}
+
+// statusLine returns the line of /proc/self/status with given field name,
+// surrounding whitespace is trimmed.
+func statusLine(field string) (string, error) {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimSpace(line), nil
+		}
+	}
+	return "", fmt.Errorf("no %s line in status", field)
+}
+
+func TestWasRebornMark(test *testing.T) {
+	outer := new(Context)
+	inner := &Context{MarkName: "_GO_DAEMON_INNER", MarkValue: "yes"}
+
+	os.Setenv(MARK_NAME, MARK_VALUE)
+	defer os.Unsetenv(MARK_NAME)
+	if !outer.WasReborn() || !WasReborn() {
+		test.Fatal("WasReborn(): default mark was not detected")
+	}
+	if inner.WasReborn() {
+		test.Fatal("WasReborn(): inner context detected the default mark")
+	}
+
+	if err := inner.prepareEnv(); err != nil {
+		test.Fatal(err)
+	}
+	os.Unsetenv(MARK_NAME)
+	for _, v := range inner.Env {
+		if kv := strings.SplitN(v, "=", 2); kv[0] == inner.MarkName {
+			os.Setenv(kv[0], kv[1])
+			defer os.Unsetenv(kv[0])
+		}
+	}
+	if !inner.WasReborn() {
+		test.Fatal("WasReborn(): inner mark was not set")
+	}
+	if outer.WasReborn() {
+		test.Fatal("WasReborn(): outer context detected the inner mark")
+	}
+}
+
+func TestIsDaemonReady(test *testing.T) {
+	os.Setenv(MARK_NAME, MARK_VALUE)
+	reborn := WasReborn()
+	os.Unsetenv(MARK_NAME)
+	if !reborn || IsDaemonReady() {
+		test.Fatal("IsDaemonReady(): not initialized process is ready")
+	}
+
+	dmn := newTestContext(test, "daemonready")
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "true\n")
+}
+
+// deadPid returns the id of a process which has already exited.
+func deadPid(test *testing.T) int {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		test.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+// helperEnvName is the environment variable that selects the function run
+// by the reborn test binary, see TestMain.
+const helperEnvName = "_GO_DAEMON_TEST_HELPER"
+
+// helpers holds functions which are executed in the daemon-process.
+var helpers = map[string]func(d *Context) error{
+	"serve": func(d *Context) error {
+		return ServeSignals()
+	},
+	// ignore ignores SIGTERM and never exits
+	"ignore": func(d *Context) error {
+		signal.Ignore(syscall.SIGTERM)
+		fmt.Println("ready")
+		time.Sleep(time.Hour)
+		return nil
+	},
+	// slowstop exits a while after SIGTERM and prints whether its pid file
+	// is kept meanwhile
+	"slowstop": func(d *Context) error {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM)
+		fmt.Println("ready")
+		<-ch
+		time.Sleep(300 * time.Millisecond)
+		_, err := os.Stat(d.PidFileName)
+		fmt.Println(err == nil)
+		return nil
+	},
+	// groups prints Groups line of the daemon-process status
+	"groups": func(d *Context) error {
+		line, err := statusLine("Groups")
+		fmt.Println(line)
+		return err
+	},
+	// umask creates a file and prints its permissions
+	"umask": func(d *Context) error {
+		name := filepath.Join(filepath.Dir(d.LogFileName), "umask")
+		if err := ioutil.WriteFile(name, nil, 0666); err != nil {
+			return err
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		fmt.Println(fi.Mode().Perm())
+		return nil
+	},
+	// rlimit prints limit of open files
+	"rlimit": func(d *Context) error {
+		var rlimit syscall.Rlimit
+		if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+			return err
+		}
+		fmt.Println(rlimit.Cur, rlimit.Max)
+		return nil
+	},
+	// extra writes into the first extra file
+	"extra": func(d *Context) error {
+		f := d.ExtraFile(0)
+		if f == nil || d.ExtraFile(1) != nil {
+			return fmt.Errorf("extra files: %v", d.ExtraFiles)
+		}
+		_, err := fmt.Fprintln(f, "extra")
+		return err
+	},
+	// streams writes into stdout and stderr
+	"streams": func(d *Context) error {
+		fmt.Fprintln(os.Stdout, "stdout")
+		fmt.Fprintln(os.Stderr, "stderr")
+		return nil
+	},
+	// rotate reopens log on SIGUSR1 and prints a line on SIGHUP
+	"rotate": func(d *Context) error {
+		fmt.Println("before")
+		return d.ServeSignals(map[syscall.Signal]func() error{
+			syscall.SIGUSR1: d.ReopenLog,
+			syscall.SIGHUP: func() error {
+				_, err := fmt.Println("after")
+				return err
+			},
+		})
+	},
+	"hup": func(d *Context) error {
+		return d.ServeSignals(map[syscall.Signal]func() error{
+			syscall.SIGHUP: func() error {
+				fmt.Println("hup")
+				return nil
+			},
+		})
+	},
+	// queuedhup receives SIGHUP before it serves signals and prints, once
+	// the handler is called
+	"queuedhup": func(d *Context) error {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			return err
+		}
+		// SIGHUP would have killed the daemon-process by now
+		time.Sleep(100 * time.Millisecond)
+		err := d.ServeSignals(map[syscall.Signal]func() error{
+			syscall.SIGHUP: func() error {
+				fmt.Println("hup")
+				return ErrStop
+			},
+		})
+		if err == ErrStop {
+			err = nil
+		}
+		return err
+	},
+	// ready gets ready after a delay
+	"ready": func(d *Context) error {
+		time.Sleep(300 * time.Millisecond)
+		if err := d.NotifyReady(); err != nil {
+			return err
+		}
+		return ServeSignals()
+	},
+	// envsize prints the total size of the environment of the context
+	"envsize": func(d *Context) error {
+		fmt.Println(len(strings.Join(d.Env, "\n")))
+		return nil
+	},
+	// exit fails to initialize with status 3
+	"exit": func(d *Context) error {
+		os.Exit(3)
+		return nil
+	},
+	// stdin echoes a line of stdin
+	"stdin": func(d *Context) error {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		fmt.Print(line)
+		return err
+	},
+	// handshake echoes a line of stdin, writes into the first extra file
+	// and prints the variable of the handshake
+	"handshake": func(d *Context) error {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err = fmt.Fprintln(d.ExtraFile(0), "extra"); err != nil {
+			return err
+		}
+		d.ExtraFile(0).Close()
+		if err = d.NotifyReady(); err != nil {
+			return err
+		}
+		fmt.Print(line)
+		fmt.Println(os.Getenv(handshakeEnvName))
+		return nil
+	},
+	// listen answers a connection on the socket of socket activation with
+	// its name and the variable of socket activation
+	"listen": func(d *Context) error {
+		files := d.ListenFiles()
+		if len(files) != 1 {
+			return fmt.Errorf("listen files: %v", files)
+		}
+		ln, err := net.FileListener(files[0])
+		if err != nil {
+			return err
+		}
+		defer ln.Close()
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = fmt.Fprintf(conn, "%s %q\n", files[0].Name(), os.Getenv(listenFdsEnvName))
+		return err
+	},
+	// foreground echoes a line of stdin and prints its process group
+	// into stderr
+	"foreground": func(d *Context) error {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		fmt.Print(line)
+		fmt.Fprintln(os.Stderr, syscall.Getpgrp())
+		return err
+	},
+	// args prints the arguments of the daemon-process
+	"args": func(d *Context) error {
+		fmt.Println(os.Args[1:])
+		return nil
+	},
+	"reexec": func(d *Context) error {
+		ln, err := net.FileListener(d.ExtraFile(0))
+		if err != nil {
+			return err
+		}
+		switch os.Getenv(reexecEnvName) {
+		case "":
+			if err = d.NotifyReady(); err != nil {
+				return err
+			}
+			// the first new copy fails, the second one replaces the daemon
+			env := d.Env[:len(d.Env):len(d.Env)]
+			d.Env = append(env, reexecEnvName+"=fail")
+			if err = d.ReExec(); !errors.Is(err, ErrNotReady) {
+				return fmt.Errorf("ReExec() of failing copy: %v", err)
+			}
+			if pid, err := ReadPidFile(d.PidFileName); err != nil || pid != os.Getpid() {
+				return fmt.Errorf("pid file after failed ReExec(): %d, %v", pid, err)
+			}
+			d.Env = append(env, reexecEnvName+"=new")
+			return d.ReExec()
+		case "fail":
+			return errors.New("fail")
+		}
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				fmt.Fprintln(conn, os.Getpid())
+				conn.Close()
+			}
+		}()
+		if err = d.NotifyReady(); err != nil {
+			return err
+		}
+		return ServeSignals()
+	},
+	"secret": func(d *Context) error {
+		fmt.Printf("%q\n", os.Getenv("SECRET_TOKEN"))
+		return nil
+	},
+	"ids": func(d *Context) error {
+		fmt.Println(os.Getuid(), os.Getgid())
+		return nil
+	},
+	// exe prints the executable of the daemon-process
+	"exe": func(d *Context) error {
+		exe, err := GetExecPath(os.Getpid())
+		fmt.Println(exe)
+		return err
+	},
+	// context prints the context passed to the daemon-process
+	"context": func(d *Context) error {
+		data, err := json.Marshal(d)
+		fmt.Println(string(data))
+		return err
+	},
+	// logfile writes into the log file and checks it is the configured one
+	"logfile": func(d *Context) error {
+		f := d.LogFile()
+		if f == nil {
+			return errors.New("no log file")
+		}
+		fmt.Fprintln(f, "logfile")
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		expected, err := os.Stat(d.LogFileName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(f, os.SameFile(fi, expected))
+		return nil
+	},
+	// usr1 prints a line on SIGUSR1 and exits
+	"usr1": func(d *Context) error {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGUSR1)
+		if err := d.NotifyReady(); err != nil {
+			return err
+		}
+		<-ch
+		fmt.Println("usr1")
+		return nil
+	},
+	// fds prints the names of open files, except standard streams
+	"fds": func(d *Context) error {
+		names, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return err
+		}
+		for _, fi := range names {
+			if link, err := os.Readlink("/proc/self/fd/" + fi.Name()); err == nil {
+				fmt.Println(link)
+			}
+		}
+		return nil
+	},
+	// session prints session id and process group id
+	"session": func(d *Context) error {
+		fmt.Println(getsid(), syscall.Getpgrp())
+		return nil
+	},
+	// leader starts a daemon, which prints its session, from the new
+	// session and prints its pid or "setsid", if the start is refused
+	"leader": func(d *Context) error {
+		if getsid() != os.Getpid() {
+			return errors.New("the daemon-process is not a session leader")
+		}
+		nested := &Context{
+			Args:           os.Args[:1],
+			MarkName:       "_GO_DAEMON_NESTED",
+			KeepStdStreams: true,
+		}
+		for _, kv := range os.Environ() {
+			if !strings.HasPrefix(kv, helperEnvName+"=") {
+				nested.Env = append(nested.Env, kv)
+			}
+		}
+		nested.Env = append(nested.Env, helperEnvName+"=session")
+		child, err := nested.Reborn()
+		if errors.Is(err, ErrSetsid) {
+			fmt.Println("setsid")
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if _, err = child.Wait(); err != nil {
+			return err
+		}
+		fmt.Println(child.Pid)
+		return nil
+	},
+	// sched prints allowed CPUs and nice value
+	"sched": func(d *Context) error {
+		cpus, err := statusLine("Cpus_allowed_list")
+		if err != nil {
+			return err
+		}
+		nice, err := syscall.Getpriority(syscall.PRIO_PROCESS, 0)
+		if err != nil {
+			return err
+		}
+		// the nice value belongs to threads, all of them have it
+		tasks, err := ioutil.ReadDir("/proc/self/task")
+		same := true
+		for _, task := range tasks {
+			tid, _ := strconv.Atoi(task.Name())
+			n, e := syscall.Getpriority(syscall.PRIO_PROCESS, tid)
+			same = same && e == nil && n == nice
+		}
+		// the raw syscall returns 20-nice
+		fmt.Println(cpus, 20-nice, same)
+		return err
+	},
+	// oom prints OOM score adjustment
+	"oom": func(d *Context) error {
+		data, err := ioutil.ReadFile("/proc/self/oom_score_adj")
+		fmt.Print(string(data))
+		return err
+	},
+	// daemonready prints whether the daemon-process is initialized
+	"daemonready": func(d *Context) error {
+		fmt.Println(IsDaemonReady())
+		return nil
+	},
+	// names prints the names of pid and log files and the working directory
+	"names": func(d *Context) error {
+		wd, err := os.Getwd()
+		fmt.Println(d.PidFileName, d.LogFileName, filepath.Base(wd))
+		return err
+	},
+	// resolved prints the resolved name of pid file and the working
+	// directory, then serves
+	"resolved": func(d *Context) error {
+		wd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		fmt.Println(d.ResolvedPidFile(), filepath.Base(wd))
+		return ServeSignals()
+	},
+	// pid prints pid of the daemon-process and serves
+	"pid": func(d *Context) error {
+		fmt.Println(os.Getpid())
+		return ServeSignals()
+	},
+	// drain prints a line in OnStop after a delay, unless it is cancelled,
+	// and whether pid file is released after serving
+	"drain": func(d *Context) error {
+		d.OnStop = func(ctx context.Context) {
+			select {
+			case <-time.After(300 * time.Millisecond):
+				fmt.Println("drained")
+			case <-ctx.Done():
+			}
+		}
+		if err := d.NotifyReady(); err != nil {
+			return err
+		}
+		err := d.ServeSignals(nil)
+		fmt.Println("released", d.pidFile == nil)
+		return err
+	},
+	// name prints program name and command name
+	"name": func(d *Context) error {
+		comm, err := ioutil.ReadFile("/proc/self/comm")
+		fmt.Print(os.Args[0], " ", string(comm))
+		return err
+	},
+	// pidlabel prints the name and the content of pid file
+	"pidlabel": func(d *Context) error {
+		pid, err := d.pidFile.ReadPid()
+		fmt.Println(d.pidFile.Name(), pid == os.Getpid())
+		return err
+	},
+	// trap prints the number of the first received signal
+	"trap": func(d *Context) error {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT,
+			syscall.SIGHUP, syscall.SIGUSR1)
+		fmt.Println("ready")
+		fmt.Println(int((<-ch).(syscall.Signal)))
+		return nil
+	},
+}
+
+// failsEnvName is the environment variable, which gives the number of runs
+// of superviseWorker, which fail, and the file counting the runs.
+const failsEnvName = "_GO_DAEMON_TEST_FAILS"
+
+// superviseWorker is run by the worker process of the "supervise" helper.
+// It serves signals, once the given number of runs has failed.
+func superviseWorker() error {
+	var fails int
+	var counter string
+	fmt.Sscan(os.Getenv(failsEnvName), &fails, &counter)
+	f, err := os.OpenFile(counter, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	f.Write([]byte{'.'})
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Println("run", fi.Size())
+	if fi.Size() <= int64(fails) {
+		return errors.New("crash")
+	}
+	if fails < 0 {
+		fmt.Println("ready")
+		return ServeSignals()
+	}
+	return nil
+}
+
+// hookErrorEnvName is the environment variable, which makes OnPrivileged
+// of the "privileged" helper fail.
+const hookErrorEnvName = "_GO_DAEMON_TEST_HOOK_ERROR"
+
+// listenPrivileged listens on a free port below 1024.
+func listenPrivileged() (ln net.Listener, err error) {
+	if len(os.Getenv(hookErrorEnvName)) > 0 {
+		return nil, errors.New("hook failed")
+	}
+	for port := 1023; port >= 1000; port-- {
+		if ln, err = net.Listen("tcp", fmt.Sprint("127.0.0.1:", port)); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(helperEnvName); name != "" && WasReborn() {
+		os.Exit(runHelper(name))
+	}
+	if logName := os.Getenv(activatedEnvName); logName != "" && !WasReborn() {
+		os.Exit(runActivated(logName))
+	}
+	if dir := os.Getenv(foregroundEnvName); dir != "" && !WasReborn() {
+		os.Exit(runForeground(dir))
+	}
+	os.Exit(m.Run())
+}
+
+// foregroundEnvName is the environment variable with the directory of
+// the process, which runs StartForeground, see runForeground.
+const foregroundEnvName = "_GO_DAEMON_TEST_FOREGROUND"
+
+// runForeground runs StartForeground in the directory with umask 027 and,
+// if it runs as root, as nobody. main prints its pid, the pid from the pid
+// file, uid, umask and working directory.
+func runForeground(dir string) int {
+	dmn := &Context{
+		PidFileName: filepath.Join(dir, "pid"),
+		PidFilePerm: fileperm,
+		WorkDir:     dir,
+		Umask:       027,
+	}
+	if os.Getuid() == 0 {
+		dmn.Credential = &syscall.Credential{Uid: 65534, Gid: 65534}
+	}
+	err := dmn.StartForeground(func() {
+		pid, err := ReadPidFile(dmn.PidFileName)
+		wd, _ := os.Getwd()
+		fmt.Printf("%d %d %v %d %o %s\n", os.Getpid(), pid, err, os.Getuid(), syscall.Umask(0), wd)
+	})
+	if err != nil {
+		log.Println("start foreground:", err)
+		return 2
+	}
+	return 0
+}
+
+// activatedEnvName is the environment variable with the log file of
+// the process started by simulated socket activation, see runActivated.
+const activatedEnvName = "_GO_DAEMON_TEST_ACTIVATED"
+
+// runActivated reborns the test binary in the process, which is started
+// with the sockets of socket activation. systemd sets LISTEN_PID after fork,
+// the process sets it itself.
+func runActivated(logName string) int {
+	os.Setenv(listenPidEnvName, strconv.Itoa(os.Getpid()))
+	dmn := &Context{
+		LogFileName: logName,
+		Args:        os.Args[:1],
+		Env:         os.Environ(),
+	}
+	if _, err := dmn.Reborn(); err != nil {
+		log.Println("reborn:", err)
+		return 2
+	}
+	return 0
+}
+
+func runHelper(name string) int {
+	// stuck never reads the context from parent
+	if name == "stuck" {
+		time.Sleep(time.Hour)
+		return 0
+	}
+	// daemonize serves until SIGTERM
+	if name == "daemonize" {
+		err := new(Context).Daemonize(func() error {
+			fmt.Println("run")
+			time.Sleep(time.Hour)
+			return nil
+		})
+		if err != nil {
+			log.Println("daemonize:", err)
+			return 1
+		}
+		return 0
+	}
+
+	// run prints and exits, or serves until SIGTERM with StopOnSignal
+	if name == "run" {
+		dmn := new(Context)
+		err := dmn.Run(func() {
+			fmt.Println("run")
+			if dmn.StopOnSignal {
+				time.Sleep(time.Hour)
+			}
+		})
+		log.Println("run:", err)
+		return 2
+	}
+
+	// supervise runs a worker, which fails the number of times given
+	// by the environment
+	if name == "supervise" {
+		// the least delay before restarts
+		err := new(Context).Supervise(superviseWorker, RestartPolicy{MaxRestarts: 2})
+		if err != nil {
+			log.Println("supervise:", err)
+			return 1
+		}
+		return 0
+	}
+
+	// logger writes the messages of Logger, set before Reborn, into stdout
+	if name == "logger" {
+		dmn := &Context{Logger: writerLogger{os.Stdout}}
+		if _, err := dmn.Reborn(); err != nil {
+			log.Println("reborn:", err)
+			return 2
+		}
+		dmn.Release()
+		return 0
+	}
+
+	// privileged listens on a privileged port in OnPrivileged, set before
+	// Reborn, and prints the port and the uid the daemon runs with
+	if name == "privileged" {
+		var ln net.Listener
+		dmn := &Context{OnPrivileged: func() (err error) {
+			ln, err = listenPrivileged()
+			return
+		}}
+		if _, err := dmn.Reborn(); err != nil {
+			log.Println("reborn:", err)
+			return 2
+		}
+		defer dmn.Release()
+		defer ln.Close()
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		n, _ := strconv.Atoi(port)
+		fmt.Println(n < 1024, os.Getuid())
+		return 0
+	}
+
+	dmn := new(Context)
+	if _, err := dmn.Reborn(); err != nil {
+		log.Println("reborn:", err)
+		return 2
+	}
+	defer dmn.Release()
+
+	if err := helpers[name](dmn); err != nil {
+		log.Println(name+":", err)
+		return 1
+	}
+	return 0
+}
+
+// newTestContext returns a context which reborns the test binary and runs
+// the named helper in the daemon-process.
+func newTestContext(test *testing.T, helper string) *Context {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		test.Fatal(err)
+	}
+	test.Cleanup(func() { os.RemoveAll(dir) })
+
+	return &Context{
+		PidFileName: filepath.Join(dir, "pid"),
+		PidFilePerm: fileperm,
+		LogFileName: filepath.Join(dir, "log"),
+		Args:        []string{os.Args[0]},
+		Env:         append(os.Environ(), helperEnvName+"="+helper),
+		Out:         ioutil.Discard,
+	}
+}
+
+// copyExec copies the test binary into dir and returns the path of the copy.
+func copyExec(test *testing.T, dir string) string {
+	exe, err := GetExecPath(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(exe)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		test.Fatal(err)
+	}
+	path := filepath.Join(dir, "daemon.test")
+	if err = ioutil.WriteFile(path, data, 0755); err != nil {
+		test.Fatal(err)
+	}
+	return path
+}
+
+// startHelper reborns the test binary in the given context and waits until
+// the daemon-process writes its pid.
+func startHelper(test *testing.T, dmn *Context) *os.Process {
+	child, err := dmn.Reborn()
+	if err != nil {
+		test.Fatal(err)
+	}
+	waitPidFile(test, dmn, child)
+	return child
+}
+
+// waitPidFile waits until the started daemon writes its pid file.
+func waitPidFile(test *testing.T, dmn *Context, child *os.Process) {
+	for i := 0; i < 100; i++ {
+		if pid, err := ReadPidFile(dmn.PidFileName); err == nil && pid == child.Pid {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	child.Kill()
+	child.Wait()
+	test.Fatal("daemon did not write pid file")
+}
+
+// waitLog waits until the log file of the daemon has the given content.
+func waitLog(test *testing.T, dmn *Context, text string) {
+	var data []byte
+	for i := 0; i < 100; i++ {
+		data, _ = ioutil.ReadFile(dmn.LogFileName)
+		if string(data) == text {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.Fatalf("log content: %q, expected: %q", data, text)
+}
@@ -0,0 +1,482 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// ErrNotSupported indicates that the requested option is not available on
+// Windows.
+var ErrNotSupported = errors.New("not supported on windows")
+
+var procSetStdHandle = modkernel32.NewProc("SetStdHandle")
+
+// Constants missing in package syscall.
+const (
+	_DETACHED_PROCESS = 0x00000008
+	_STD_INPUT_HANDLE = 1<<32 - 10 // (DWORD)-10
+)
+
+// Time the daemon-process waits for the parent to release the pid file lock.
+const lockTimeout = 5 * time.Second
+
+// A Context describes daemon context.
+// On Windows Credential is not available and Chroot is not supported.
+//
+// Parent process passes the context to the daemon-process encoded to JSON.
+// The daemon-process gets all exported fields with the values they have
+// in parent at the time of Reborn, including Args and Env completed by
+// Reborn, except writers and callbacks. The values replace the ones set
+// in the daemon-process before Reborn. Unexported fields are not passed.
+// Writers and callbacks keep the values set in the daemon-process.
+type Context struct {
+	// If PidFileName is non-empty, parent process will try to create and lock
+	// pid file with given name. Child process locks the file once the parent
+	// releases it and writes process id to file.
+	// Relative names of pid and log files are resolved against the working
+	// directory of parent, Reborn replaces them by absolute ones, so they
+	// refer to the same files in the daemon-process after WorkDir is applied.
+	PidFileName string
+	// PidFileLabel is ignored, the daemon-process opens PidFileName.
+	PidFileLabel string
+	// Permissions for new pid file. If zero, FILE_PERM is used.
+	PidFilePerm os.FileMode
+	// PidFileInfo is written into pid file after the pid, e.g. version
+	// of the program, see WritePidInfo.
+	PidFileInfo map[string]string
+	// If PidFileHost is true, the hostname is written into pid file as
+	// "host=<hostname>", e.g. if pid files are on storage shared by hosts.
+	// The functions, which signal the daemon, refuse to signal the pid
+	// written by another host, see ErrOtherHost.
+	PidFileHost bool
+	// If the pid file is locked by another instance, e.g. the previous one
+	// is still exiting, Reborn retries to lock it LockRetries times,
+	// LockRetryInterval apart, before it fails with ErrWouldBlock, which
+	// StartE reports as ErrAlreadyRunning. If zero, it fails at once.
+	// If LockRetryInterval is zero, 100ms is used.
+	LockRetries       int
+	LockRetryInterval time.Duration
+	// LockDir is not supported, Reborn fails if it is true.
+	LockDir bool
+
+	// If LogFileName is non-empty, parent process will create file with given name
+	// and will link to stdout and stderr for child process.
+	LogFileName string
+	// Permissions for new log file. If zero, FILE_PERM is used.
+	LogFilePerm os.FileMode
+	// Flags of opening LogFileName and StderrFileName by parent process,
+	// e.g. with os.O_TRUNC to start with empty log. They must include
+	// os.O_WRONLY or os.O_RDWR. If zero, os.O_WRONLY|os.O_CREATE|os.O_APPEND
+	// is used.
+	LogFileFlag int
+
+	// If StderrFileName is non-empty, parent process will create file with
+	// given name and will link to stderr for child process, LogFileName is
+	// used only for stdout then.
+	StderrFileName string
+	// Permissions for new stderr file. If zero, FILE_PERM is used.
+	StderrFilePerm os.FileMode
+
+	// If LogWriter is non-nil, stdout and stderr of the daemon-process are
+	// written into a pipe, which parent process reads and copies into
+	// LogWriter, e.g. to add timestamps or to ship the output to a remote
+	// collector. LogWriter excludes LogFileName and StderrFileName.
+	// The copying goroutine lives in parent process, so parent must keep
+	// running while the daemon writes, e.g. call Wait, which returns once
+	// the output is copied.
+	LogWriter io.Writer `json:"-"`
+
+	// If WorkDir is non-empty, the child changes into the directory before
+	// creating the process.
+	WorkDir string
+	// Chroot is not supported, Reborn fails if it is non-empty.
+	Chroot string
+
+	// MarkName and MarkValue give the environment variable, which marks
+	// the daemon-process. If empty, MARK_NAME and MARK_VALUE are used.
+	// Programs, which run each other, should use distinct marks.
+	MarkName  string
+	MarkValue string
+
+	// If Env is non-nil, it gives the environment variables for the
+	// daemon-process in the form returned by os.Environ.
+	// If it is nil, the result of os.Environ will be used.
+	Env []string
+	// If EnvFilter is non-nil, only the variables of Env, for which it
+	// returns true, are passed to the daemon-process, e.g. to leave out
+	// secrets. The mark of the daemon-process is always passed.
+	EnvFilter func(key, value string) bool `json:"-"`
+	// If Args is non-nil, it gives the command-line args for the
+	// daemon-process. If it is nil, the result of os.Args will be used
+	// (without program name).
+	Args []string
+	// Subcommand is the control argument of the program, which runs Start,
+	// e.g. "start" of "myd start". If Args is nil, its first occurrence
+	// is removed from os.Args, so the daemon-process does not start itself
+	// again. Otherwise Args must leave it out.
+	Subcommand string
+
+	// ProcessName is ignored.
+	ProcessName string
+
+	// DoubleFork is ignored, the daemon-process never becomes a zombie.
+	DoubleFork bool
+
+	// CloseFDs is ignored, the daemon-process inherits only standard handles.
+	CloseFDs bool
+
+	// NoSetsid and Setpgid are ignored, the daemon-process is started
+	// in a new process group.
+	NoSetsid bool
+	Setpgid  bool
+
+	// StdinFile is not supported, Reborn fails if it is non-nil.
+	StdinFile *os.File `json:"-"`
+
+	// SocketHandshake is not supported, Reborn fails if it is true.
+	SocketHandshake bool
+
+	// If KeepStdStreams is true, the daemon-process gets stdout and stderr
+	// of parent instead of the null device, e.g. to be captured by a process
+	// supervisor. It excludes LogFileName, StderrFileName and LogWriter.
+	KeepStdStreams bool
+
+	// If Foreground is true, the daemon-process stays attached to the console
+	// of parent and writes into its stdout and stderr, e.g. to run the program
+	// in foreground during development. LogFileName, StderrFileName and
+	// LogWriter are ignored then. Stdin is not passed, it is the null device.
+	Foreground bool
+
+	// NewPIDNamespace and Cloneflags are not supported, Reborn fails if
+	// either is set.
+	NewPIDNamespace bool
+	Cloneflags      uintptr
+
+	// Capabilities are not supported, Reborn fails if it is non-empty.
+	Capabilities []uintptr
+	// DropAtExec is not supported, Reborn fails if it is set.
+	DropAtExec bool
+	// ChownFiles is not supported, Reborn fails if it is set.
+	ChownFiles bool
+
+	// CPUAffinity, Nice and OOMScoreAdj are ignored.
+	CPUAffinity []int
+	Nice        int
+	OOMScoreAdj *int
+
+	// Umask and SetUmask are ignored.
+	Umask    int
+	SetUmask bool
+
+	// If ExecPath is non-empty, the daemon-process runs the executable with
+	// given path, e.g. an upgraded copy of the program, instead of the
+	// executable of the current process, which is looked up by its handle. A name
+	// without path separators is searched in PATH. The status and stop
+	// functions identify the daemon by ExecName, set it to ExecPath, if
+	// the executables differ.
+	ExecPath string
+
+	// If ExecName is non-empty, the status and stop functions identify the
+	// daemon-process by its executable, given either by path or by base
+	// name, instead of the executable of the current process. It allows
+	// to check a daemon, whose binary is renamed or replaced.
+	ExecName string
+
+	// StopSignal is ignored, Windows has no signals and Stop terminates
+	// the daemon-process.
+	StopSignal syscall.Signal
+
+	// If StopTimeout is non-zero, Stop waits for the daemon to exit no longer
+	// than StopTimeout. Otherwise Stop waits unboundedly.
+	StopTimeout time.Duration
+
+	// RestartTimeout limits how long Restart waits for the running daemon
+	// to exit and release the pid file. If zero, RESTART_TIMEOUT is used.
+	RestartTimeout time.Duration
+
+	// If StopOnSignal is true, Run exits the daemon-process once SIGTERM
+	// or SIGINT is received and OnStop returns, like Daemonize. Otherwise
+	// Run leaves signals to its main function.
+	StopOnSignal bool
+
+	// If QueueSignals is true, SIGHUP received by the daemon-process after
+	// Reborn is queued until Context.ServeSignals serves it. Set it only if
+	// the daemon-process calls Context.ServeSignals, SIGHUP is ignored until
+	// then. Otherwise SIGHUP has its default action.
+	QueueSignals bool
+
+	// Out receives messages of Start, Stop, Kill, Restart and Status.
+	// If it is nil, os.Stdout is used.
+	Out io.Writer `json:"-"`
+
+	// If Logger is non-nil, it receives debug messages about the steps of
+	// Reborn in parent and in the daemon-process, e.g. to find out why
+	// the daemon-process fails to initialize, and their errors. Logger set
+	// in the daemon-process before Reborn is kept there.
+	Logger Logger `json:"-"`
+
+	// OnFork is called in parent process once the daemon-process is started
+	// and has got the context. Its error is returned by Reborn, the started
+	// daemon-process keeps running.
+	OnFork func(child *os.Process) error `json:"-"`
+
+	// OnStop is called in the daemon-process by Context.ServeSignals and
+	// Daemonize, when SIGTERM or SIGINT is received, e.g. to drain
+	// connections. They wait for OnStop to return before the pid file is
+	// released, but no longer than StopTimeout, if it is non-zero: ctx is
+	// cancelled then.
+	OnStop func(ctx context.Context) `json:"-"`
+
+	// OnPrivileged is called in the daemon-process, once it has locked
+	// the pid file, there are no privileges to drop on Windows. If it returns
+	// error, Reborn fails in the daemon-process and the pid file is removed.
+	OnPrivileged func() error `json:"-"`
+
+	// Struct contains only serializable public fields (!!!)
+	abspath  string
+	childPid int
+	pidFile  *LockFile
+	dirLock  *DirLock
+	logFile  *os.File
+	errFile  *os.File
+	nullFile *os.File
+	// closed once the output of the daemon-process is copied to LogWriter
+	logDone chan struct{}
+
+	rpipe, wpipe *os.File
+}
+
+// checkOptions reports options, which are not supported.
+func (d *Context) checkOptions() error {
+	if len(d.Chroot) > 0 || d.NewPIDNamespace || d.Cloneflags != 0 || len(d.Capabilities) > 0 ||
+		d.DropAtExec || d.ChownFiles || d.StdinFile != nil || d.SocketHandshake ||
+		d.LockDir {
+		return ErrNotSupported
+	}
+	if d.LogWriter != nil && (len(d.LogFileName) > 0 || len(d.StderrFileName) > 0) {
+		return errLogWriter
+	}
+	if d.KeepStdStreams && (len(d.LogFileName) > 0 || len(d.StderrFileName) > 0 || d.LogWriter != nil) {
+		return errKeepStdStreams
+	}
+	if !validLogFileFlag(d.LogFileFlag) {
+		return errLogFileFlag
+	}
+	return nil
+}
+
+// removePidFile removes the pid file of the daemon-process.
+func (d *Context) removePidFile() error {
+	return d.pidFile.Remove()
+}
+
+// pidFileOwners returns nil, the owner of pid file is not checked.
+func (d *Context) pidFileOwners() []int {
+	return nil
+}
+
+// checkCredential does nothing, Credential is not available.
+func (d *Context) checkCredential() error {
+	return nil
+}
+
+func (d *Context) parent(ctx context.Context) (child *os.Process, err error) {
+	if err = d.checkOptions(); err != nil {
+		return
+	}
+	if err = d.prepareEnv(); err != nil {
+		return
+	}
+
+	defer d.closeFiles()
+	if err = d.openFiles(); err != nil {
+		return
+	}
+
+	attr := &os.ProcAttr{
+		Dir:   d.WorkDir,
+		Env:   d.Env,
+		Files: []*os.File{d.rpipe, d.stdout(), d.stderr()},
+		Sys: &syscall.SysProcAttr{
+			HideWindow:    true,
+			CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | _DETACHED_PROCESS,
+		},
+	}
+	if d.Foreground {
+		attr.Sys = &syscall.SysProcAttr{}
+	}
+	d.logger().Debugf("starting daemon-process %s %q", d.abspath, d.Args)
+	if child, err = os.StartProcess(d.abspath, d.Args, attr); err != nil {
+		return
+	}
+	d.childPid = child.Pid
+	d.rpipe.Close()
+	d.logger().Debugf("started daemon-process %d", child.Pid)
+	if err = d.sendConfig(ctx, child, d); err == nil {
+		d.logger().Debugf("sent context to daemon-process %d", child.Pid)
+	}
+
+	return
+}
+
+func (d *Context) openFiles() (err error) {
+	if d.nullFile, err = os.Open(os.DevNull); err != nil {
+		return
+	}
+
+	// Locks are not inherited by the child, so the parent holds the lock
+	// only until the child is started.
+	if len(d.PidFileName) > 0 {
+		if d.pidFile, err = OpenLockFile(d.PidFileName, filePerm(d.PidFilePerm)); err != nil {
+			return
+		}
+		if err = d.lockPidFile(); err != nil {
+			d.pidFile.Close()
+			d.pidFile = nil
+			return
+		}
+	}
+
+	if len(d.LogFileName) > 0 && !d.Foreground {
+		if d.logFile, err = d.openLogFile(d.LogFileName, d.LogFilePerm); err != nil {
+			return
+		}
+	}
+	if len(d.StderrFileName) > 0 && !d.Foreground {
+		if d.errFile, err = d.openLogFile(d.StderrFileName, d.StderrFilePerm); err != nil {
+			return
+		}
+	}
+	if d.LogWriter != nil && !d.Foreground {
+		if d.logFile, err = d.startLogWriter(); err != nil {
+			return
+		}
+	}
+
+	d.rpipe, d.wpipe, err = os.Pipe()
+	return
+}
+
+func (d *Context) closeFiles() (err error) {
+	cl := func(file **os.File) {
+		if *file != nil {
+			(*file).Close()
+			*file = nil
+		}
+	}
+	cl(&d.rpipe)
+	cl(&d.wpipe)
+	cl(&d.logFile)
+	cl(&d.errFile)
+	cl(&d.nullFile)
+	if d.pidFile != nil {
+		d.pidFile.Close()
+		d.pidFile = nil
+	}
+	return
+}
+
+func (d *Context) child() (err error) {
+	if initialized {
+		return os.ErrInvalid
+	}
+	initialized = true
+
+	// decode into a zero context, so values set in the daemon-process
+	// are replaced rather than merged with the passed ones
+	conf := new(Context)
+	decoder := json.NewDecoder(os.Stdin)
+	if err = decoder.Decode(conf); err != nil {
+		return fmt.Errorf("decode context of parent: %w", err)
+	}
+	if err = conf.check(); err != nil {
+		return
+	}
+	d.keepLocal(conf)
+	*d = *conf
+
+	if d.nullFile, err = os.Open(os.DevNull); err != nil {
+		return
+	}
+	if r, _, e := procSetStdHandle.Call(_STD_INPUT_HANDLE,
+		d.nullFile.Fd()); r == 0 {
+		return e
+	}
+	os.Stdin.Close()
+	os.Stdin = d.nullFile
+
+	if len(d.PidFileName) > 0 {
+		if d.pidFile, err = OpenLockFile(d.PidFileName, filePerm(d.PidFilePerm)); err != nil {
+			return
+		}
+		if err = d.pidFile.LockWithTimeout(lockTimeout); err != nil {
+			d.pidFile.Close()
+			d.pidFile = nil
+			return
+		}
+		var info map[string]string
+		if info, err = d.pidFileInfo(); err != nil {
+			return
+		}
+		if err = d.pidFile.WritePidInfo(info); err != nil {
+			return
+		}
+		d.logger().Debugf("wrote pid file %s", d.PidFileName)
+	}
+	if d.OnPrivileged != nil {
+		if err = d.OnPrivileged(); err != nil {
+			if d.pidFile != nil {
+				d.pidFile.Remove()
+				d.pidFile = nil
+			}
+			return fmt.Errorf("OnPrivileged: %w", err)
+		}
+	}
+
+	return
+}
+
+// NotifyReady is not supported on Windows.
+func (d *Context) NotifyReady() error {
+	return ErrNotSupported
+}
+
+// WaitReady is not supported on Windows.
+func (d *Context) WaitReady(timeout time.Duration) error {
+	return ErrNotSupported
+}
+
+// ListenFiles returns nil on Windows, which has no socket activation.
+func (d *Context) ListenFiles() []*os.File {
+	return nil
+}
+
+// StartForeground is not supported on Windows.
+func (d *Context) StartForeground(main func()) error {
+	return ErrNotSupported
+}
+
+// ReExec is not supported on Windows.
+func (d *Context) ReExec() error {
+	return ErrNotSupported
+}
+
+// SendSignal is not supported on Windows, use Stop or Kill.
+func (d *Context) SendSignal(sig syscall.Signal) error {
+	return ErrNotSupported
+}
+
+// Windows has no signals, so the process is terminated.
+func sendSignal(p *os.Process, sig syscall.Signal) error {
+	return p.Kill()
+}
+
+// reapForwarder does nothing, Windows has no syslog forwarder.
+func (d *Context) reapForwarder() {
+}
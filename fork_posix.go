@@ -0,0 +1,96 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variable, which makes a copy of the program the intermediate
+// process of double-fork. The value is the number of files to be passed
+// to the daemon-process, the next descriptor reports its pid.
+const forkEnvName = "_GO_DAEMON_FORK"
+
+func init() {
+	// The intermediate process is a copy of the program, so it must be caught
+	// before the program runs any code.
+	if num := os.Getenv(forkEnvName); len(num) > 0 {
+		os.Exit(forkDaemon(num))
+	}
+}
+
+// forkDaemon starts the daemon-process with the same args, environment
+// (without forkEnvName) and files, and writes its pid into the report pipe.
+func forkDaemon(num string) int {
+	n, err := strconv.Atoi(num)
+	if err != nil {
+		return 2
+	}
+	report := os.NewFile(uintptr(n), "report")
+	defer report.Close()
+
+	path, err := GetExecPath(os.Getpid())
+	if err != nil {
+		fmt.Fprintln(report, err)
+		return 1
+	}
+	var env []string
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, forkEnvName+"=") {
+			env = append(env, v)
+		}
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(i), fmt.Sprintf("fd-%d", i))
+	}
+
+	// if the intermediate process is the session leader, the daemon-process
+	// can never acquire a controlling terminal
+	attr := &os.ProcAttr{Env: env, Files: files}
+	child, err := os.StartProcess(path, os.Args, attr)
+	if err != nil {
+		fmt.Fprintln(report, err)
+		return 1
+	}
+	fmt.Fprintln(report, child.Pid)
+	return 0
+}
+
+// doubleFork starts the intermediate process with given attributes, which
+// starts the daemon-process and exits at once. The daemon-process is
+// reparented to init, so nobody has to wait for it.
+func (d *Context) doubleFork(attr *os.ProcAttr) (child *os.Process, err error) {
+	var r, w *os.File
+	if r, w, err = os.Pipe(); err != nil {
+		return
+	}
+	defer r.Close()
+
+	fork := *attr
+	fork.Files = append(attr.Files[:len(attr.Files):len(attr.Files)], w)
+	fork.Env = append(attr.Env[:len(attr.Env):len(attr.Env)],
+		fmt.Sprintf("%s=%d", forkEnvName, len(attr.Files)))
+
+	var p *os.Process
+	p, err = os.StartProcess(d.abspath, d.argv(), &fork)
+	w.Close()
+	if err != nil {
+		return
+	}
+	line, _ := bufio.NewReader(r).ReadString('\n')
+	if _, err = p.Wait(); err != nil {
+		return
+	}
+
+	var pid int
+	if pid, err = strconv.Atoi(strings.TrimSpace(line)); err != nil {
+		return nil, fmt.Errorf("double-fork: %q", strings.TrimSpace(line))
+	}
+	return os.FindProcess(pid)
+}
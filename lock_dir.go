@@ -0,0 +1,101 @@
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DirLock is a lock of single instance based on atomic creation of
+// a directory. Unlike the lock of LockFile, it is reliable on network
+// filesystems, e.g. NFS, where flock(2) may be emulated or ignored.
+// The directory holds the pid of its owner. It is not released, when
+// the owner exits, but the lock of the process, which is not alive,
+// is stale and is taken over by TryLock. The processes sharing the lock
+// must run on the same host, since the pid is checked locally.
+type DirLock struct {
+	// Name is the path of the lock directory.
+	Name string
+}
+
+// NewDirLock returns a new DirLock of the directory with given name.
+func NewDirLock(name string) *DirLock {
+	return &DirLock{name}
+}
+
+// Name of the file with the pid of owner in the lock directory.
+const dirLockPidName = "pid"
+
+// TryLock creates the lock directory and writes given pid into it, e.g.
+// of the current process. If the lock is held by a process, which is alive,
+// or the pid of its owner is not written yet, it returns ErrWouldBlock.
+func (l *DirLock) TryLock(pid int) (err error) {
+	// the stale lock is removed once, the lock is taken by another process
+	// otherwise
+	for i := 0; i < 2; i++ {
+		if err = os.Mkdir(l.Name, 0755); err == nil {
+			if err = l.SetOwner(pid); err != nil {
+				os.RemoveAll(l.Name)
+			}
+			return
+		}
+		if !os.IsExist(err) || !l.removeStale() {
+			break
+		}
+	}
+	if os.IsExist(err) {
+		err = ErrWouldBlock
+	}
+	return
+}
+
+// SetOwner replaces the pid of owner of the held lock, e.g. by the pid of
+// the started daemon-process. The pid is written into a temporary file,
+// which is renamed then, so a concurrent reader never sees a partial pid.
+func (l *DirLock) SetOwner(pid int) (err error) {
+	tmp := filepath.Join(l.Name, dirLockPidName+".tmp")
+	if err = ioutil.WriteFile(tmp, []byte(fmt.Sprintln(pid)), 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp, filepath.Join(l.Name, dirLockPidName))
+}
+
+// Owner returns the pid of owner of the lock. If the lock directory does
+// not exist, ErrNotLocked is returned.
+func (l *DirLock) Owner() (pid int, err error) {
+	if pid, err = ReadPidFile(filepath.Join(l.Name, dirLockPidName)); os.IsNotExist(err) {
+		if _, e := os.Stat(l.Name); os.IsNotExist(e) {
+			err = ErrNotLocked
+		}
+	}
+	return
+}
+
+// Unlock releases the lock, i.e. removes the lock directory.
+func (l *DirLock) Unlock() error {
+	return os.RemoveAll(l.Name)
+}
+
+// removeStale removes the lock, whose owner is not alive, and reports
+// whether the lock may be taken. The directory is renamed before removal,
+// so only one of concurrent processes removes it, and its owner is checked
+// once more, so the lock taken meanwhile by another process is restored.
+func (l *DirLock) removeStale() bool {
+	pid, err := l.Owner()
+	if err == ErrNotLocked {
+		return true
+	} else if err != nil || processExists(pid) {
+		return false
+	}
+	stale := fmt.Sprintf("%s.stale.%d", l.Name, os.Getpid())
+	if err = os.Rename(l.Name, stale); err != nil {
+		return os.IsNotExist(err)
+	}
+	if owner, err := NewDirLock(stale).Owner(); err != nil || owner != pid {
+		os.Rename(stale, l.Name)
+		return false
+	}
+	os.RemoveAll(stale)
+	return true
+}
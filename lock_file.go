@@ -0,0 +1,342 @@
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockFile wraps *os.File and provide functions for locking of files.
+type LockFile struct {
+	*os.File
+}
+
+// NewLockFile returns a new LockFile with the given File.
+func NewLockFile(file *os.File) *LockFile {
+	return &LockFile{file}
+}
+
+// CreatePidFile opens the named file, applies exclusive lock and writes
+// current process id to file.
+func CreatePidFile(name string, perm os.FileMode) (lock *LockFile, err error) {
+	if lock, err = OpenLockFile(name, perm); err != nil {
+		return
+	}
+	if err = lock.Lock(); err != nil {
+		lock.Remove()
+		return
+	}
+	if err = lock.WritePid(); err != nil {
+		lock.Remove()
+	}
+	return
+}
+
+// OpenLockFile opens the named file with flags os.O_RDWR|os.O_CREATE and specified perm.
+// If successful, function returns LockFile for opened file.
+func OpenLockFile(name string, perm os.FileMode) (lock *LockFile, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE, perm); err == nil {
+		lock = &LockFile{file}
+	}
+	return
+}
+
+// TryLock applies exclusive lock on an open file without waiting, as Lock
+// does. If the file is already locked, it returns ErrWouldBlock.
+func (file *LockFile) TryLock() error {
+	if err := file.Lock(); err != nil {
+		if errors.Is(err, ErrWouldBlock) {
+			return ErrWouldBlock
+		}
+		return err
+	}
+	return nil
+}
+
+// ErrLockTimeout indicates that the file stays locked by another process
+// longer than the timeout of LockWithTimeout.
+var ErrLockTimeout = errors.New("timeout waiting for lock")
+
+// Bounds of the interval between attempts of LockWithTimeout.
+const (
+	lockRetryMin = 10 * time.Millisecond
+	lockRetryMax = 200 * time.Millisecond
+)
+
+// LockWithTimeout applies exclusive lock on an open file as TryLock does,
+// but retries while the file is locked by another process, no longer than
+// timeout. The interval between attempts doubles up to 200ms. Returns
+// ErrLockTimeout, if the file is still locked.
+func (file *LockFile) LockWithTimeout(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	interval := lockRetryMin
+	for {
+		if err := file.TryLock(); err != ErrWouldBlock {
+			return err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return ErrLockTimeout
+		}
+		if interval > left {
+			interval = left
+		}
+		time.Sleep(interval)
+		if interval *= 2; interval > lockRetryMax {
+			interval = lockRetryMax
+		}
+	}
+}
+
+// ProbePidFile reads process id from the named pid file and reports whether
+// the file is locked by a process, i.e. the daemon is running, regardless
+// of /proc. The file is probed by shared lock, which is released at once:
+// it never conflicts with other probes and never affects the lock of
+// the daemon, even if it is the current process, since the lock belongs
+// to the open file. A daemon, which starts at the same moment, may find
+// the file locked though, and fail with ErrWouldBlock.
+func ProbePidFile(name string) (pid int, held bool, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(name, os.O_RDONLY, 0); err != nil {
+		return
+	}
+	defer file.Close()
+
+	if held, err = probeLock(file); err != nil {
+		return
+	}
+	pid, err = ReadPidFile(name)
+	return
+}
+
+// probeLock reports whether the open file is locked by a process. The file
+// is probed by shared lock, which is released at once, see ProbePidFile.
+func probeLock(file *os.File) (held bool, err error) {
+	lock := NewLockFile(file)
+	if err = lock.lockShared(); err == nil {
+		lock.Unlock()
+	} else if errors.Is(err, ErrWouldBlock) {
+		return true, nil
+	}
+	return
+}
+
+// isFileLocked reports whether the named file is locked by a process,
+// see probeLock.
+func isFileLocked(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	held, _ := probeLock(file)
+	return held
+}
+
+// ErrNotLocked indicates that no process holds the lock of the file.
+var ErrNotLocked = errors.New("file is not locked")
+
+// Owner returns pid of the process, which holds the lock of the file, e.g.
+// of the running daemon, regardless of the pid written into the file.
+// The lock belongs to the open file, which the daemon-process inherits,
+// so while it is started either of the processes may be returned.
+// If the file is not locked, ErrNotLocked is returned.
+// It is supported on Linux only.
+func (file *LockFile) Owner() (pid int, err error) {
+	var fi os.FileInfo
+	if fi, err = file.Stat(); err != nil {
+		return
+	}
+	return lockOwner(fi)
+}
+
+// Number of attempts and interval between them for reading a pid file,
+// which is being written.
+const (
+	readPidAttempts = 5
+	readPidInterval = 10 * time.Millisecond
+)
+
+// ReadPidFile reads process id from file with give name and returns pid.
+// Momentarily empty or partially written file, e.g. of a starting daemon,
+// is read again a few times. If unable read from a file, returns error.
+func ReadPidFile(name string) (pid int, err error) {
+	pid, _, err = ReadPidInfo(name)
+	return
+}
+
+// ReadPidInfo reads process id and the "key=value" lines, which follow it,
+// from file with given name, see WritePidInfo. Lines without '=' are skipped.
+func ReadPidInfo(name string) (pid int, info map[string]string, err error) {
+	var file *os.File
+	if file, err = os.OpenFile(name, os.O_RDONLY, 0640); err != nil {
+		return
+	}
+	defer file.Close()
+
+	var data []byte
+	for i := 1; ; i++ {
+		if _, err = file.Seek(0, os.SEEK_SET); err != nil {
+			return
+		}
+		if data, err = ioutil.ReadAll(file); err != nil {
+			return
+		}
+		if !isPartialPid(data) || i == readPidAttempts {
+			break
+		}
+		time.Sleep(readPidInterval)
+	}
+	lines := strings.Split(string(data), "\n")
+	if pid, err = parsePid(lines[0]); err != nil {
+		return
+	}
+
+	info = make(map[string]string)
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			info[kv[0]] = kv[1]
+		}
+	}
+	delete(info, pidSizeKey)
+	return
+}
+
+// isPartialPid reports whether data is a pid file, which is being written.
+// WritePid writes the size of the content into the second line, so the file
+// is partial, if it is empty, cut within the size line or shorter than
+// the size. Files of older versions have no size and are complete.
+func isPartialPid(data []byte) bool {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		// the pid of older versions may have no newline
+		return len(data) == 0
+	}
+	prefix := []byte(pidSizeKey + "=")
+	line := data[i+1:]
+	j := bytes.IndexByte(line, '\n')
+	if j < 0 {
+		// older versions end each line with newline
+		return len(line) > 0 && (bytes.HasPrefix(line, prefix) || bytes.HasPrefix(prefix, line))
+	}
+	if !bytes.HasPrefix(line, prefix) {
+		return false
+	}
+	size, err := strconv.Atoi(string(line[len(prefix):j]))
+	return err == nil && len(data) < size
+}
+
+// errInvalidPid indicates pid file, whose content is not a pid.
+var errInvalidPid = errors.New("invalid pid")
+
+// parsePid parses the first line of pid file. Surrounding whitespace,
+// including CR of CRLF line ending, is ignored.
+func parsePid(line string) (pid int, err error) {
+	line = strings.TrimSpace(line)
+	if pid, err = strconv.Atoi(line); err != nil || pid <= 0 {
+		return 0, fmt.Errorf("%w %q", errInvalidPid, line)
+	}
+	return
+}
+
+// Keys of the size of the content, the process start time and the hostname
+// in pid file.
+const (
+	pidSizeKey  = "size"
+	pidStartKey = "start"
+	pidHostKey  = "host"
+)
+
+// ReadPidHost returns the hostname written into the pid file with given
+// name, see Context.PidFileHost. It is empty, if the file has no hostname.
+func ReadPidHost(name string) (host string, err error) {
+	var info map[string]string
+	if _, info, err = ReadPidInfo(name); err == nil {
+		host = info[pidHostKey]
+	}
+	return
+}
+
+// WritePid writes current process id followed by newline to an open file.
+// The next line "start=..." holds the start time of the process, which allows
+// to detect reuse of the pid, see IsProcessRunning.
+// The second line "size=..." holds the size of the whole content in bytes.
+// The file is truncated first and the content is written by a single write,
+// so a concurrent reader never sees a mix of old and new content, but it may
+// see an empty or partially written file meanwhile, which ReadPidFile tells
+// by the size and reads again. The file is not replaced by rename, since
+// the lock belongs to it. The content is synced to disk before return, while
+// the caller still holds the lock.
+func (file *LockFile) WritePid() (err error) {
+	return file.WritePidInfo(nil)
+}
+
+// WritePidInfo is like WritePid, but also writes given info as "key=value"
+// lines sorted by key, e.g. version of the program. The size and the start
+// time of the process can not be overridden. Keys must not be empty or contain '=',
+// neither keys nor values may contain newlines.
+func (file *LockFile) WritePidInfo(info map[string]string) (err error) {
+	return file.writePidInfo(os.Getpid(), info)
+}
+
+// writePidInfo writes the pid file of the process with given pid.
+func (file *LockFile) writePidInfo(pid int, info map[string]string) (err error) {
+	keys := make([]string, 0, len(info))
+	for key, value := range info {
+		if len(key) == 0 || strings.ContainsAny(key, "=\r\n") || strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid pid file info %q=%q", key, value)
+		}
+		if key != pidSizeKey && key != pidStartKey {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var rest string
+	if start, err := processStartToken(pid); err == nil {
+		rest += fmt.Sprintf("%s=%s\n", pidStartKey, start)
+	}
+	for _, key := range keys {
+		rest += fmt.Sprintf("%s=%s\n", key, info[key])
+	}
+	// the size includes its own digits
+	content := fmt.Sprintln(pid)
+	base := len(content) + len(pidSizeKey+"=\n") + len(rest)
+	size := base
+	for size != base+len(strconv.Itoa(size)) {
+		size = base + len(strconv.Itoa(size))
+	}
+	content += fmt.Sprintf("%s=%d\n", pidSizeKey, size) + rest
+
+	if err = file.Truncate(0); err != nil {
+		return
+	}
+	if _, err = file.WriteAt([]byte(content), 0); err != nil {
+		return
+	}
+	err = file.Sync()
+	return
+}
+
+// ReadPid reads process id from file and returns pid.
+// If unable read from a file, returns error.
+func (file *LockFile) ReadPid() (pid int, err error) {
+	if _, err = file.Seek(0, os.SEEK_SET); err != nil {
+		return
+	}
+	var line string
+	if line, err = bufio.NewReader(file).ReadString('\n'); err != nil && err != io.EOF {
+		return
+	}
+	return parsePid(line)
+}
@@ -1,3 +1,6 @@
+//go:build !windows
+// +build !windows
+
 package daemon
 
 import (
@@ -6,7 +9,11 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -30,7 +37,7 @@ func TestCreatePidFile(test *testing.T) {
 	if err != nil {
 		test.Fatal(err)
 	}
-	if string(data) != fmt.Sprint(os.Getpid()) {
+	if !strings.HasPrefix(string(data), fmt.Sprintln(os.Getpid())) {
 		test.Fatal("pids not equal")
 	}
 
@@ -71,6 +78,199 @@ func TestGetFdName(test *testing.T) {
 	}
 }
 
+func TestTryLock(test *testing.T) {
+	locked := make(chan *LockFile)
+	go func() {
+		lock, err := CreatePidFile(filename, fileperm)
+		if err != nil {
+			test.Error(err)
+		}
+		locked <- lock
+	}()
+	lock := <-locked
+	if lock == nil {
+		return
+	}
+	defer lock.Remove()
+
+	other, err := OpenLockFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer other.Close()
+	if err = other.TryLock(); err != ErrWouldBlock {
+		test.Fatal("TryLock(): expected ErrWouldBlock, got", err)
+	}
+
+	if err = lock.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+	if err = other.TryLock(); err != nil {
+		test.Fatal("TryLock() of unlocked file:", err)
+	}
+}
+
+func TestUnlock(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+	if err = lock.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+
+	other, err := OpenLockFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer other.Close()
+	if err = other.TryLock(); err != nil {
+		test.Fatal("TryLock() of unlocked file:", err)
+	}
+	// the descriptor stays open
+	if pid, err := lock.ReadPid(); err != nil || pid != os.Getpid() {
+		test.Fatal("ReadPid() of unlocked file:", pid, err)
+	}
+	if err = lock.TryLock(); err != ErrWouldBlock {
+		test.Fatal("TryLock(): expected ErrWouldBlock, got", err)
+	}
+	if err = other.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+	if err = lock.TryLock(); err != nil {
+		test.Fatal("TryLock() of released file:", err)
+	}
+}
+
+func TestIsFileLocked(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+	if !isFileLocked(filename) {
+		test.Fatal("isFileLocked() of locked file")
+	}
+	if err = lock.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+	if isFileLocked(filename) {
+		test.Fatal("isFileLocked() of unlocked file")
+	}
+
+	// the probe is shared, so concurrent probes never conflict
+	other, err := OpenLockFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer other.Close()
+	if err = other.lockShared(); err != nil {
+		test.Fatal(err)
+	}
+	if isFileLocked(filename) {
+		test.Fatal("isFileLocked() of file probed by shared lock")
+	}
+	if err = other.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+	// the probe is released at once
+	if err = lock.TryLock(); err != nil {
+		test.Fatal("TryLock() after isFileLocked():", err)
+	}
+}
+
+func TestLockWithTimeout(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+
+	other, err := OpenLockFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer other.Close()
+	start := time.Now()
+	if err = other.LockWithTimeout(200 * time.Millisecond); err != ErrLockTimeout {
+		test.Fatal("LockWithTimeout(): expected ErrLockTimeout, got", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > time.Second {
+		test.Fatal("LockWithTimeout(): returned after", elapsed)
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		lock.Unlock()
+	}()
+	if err = other.LockWithTimeout(5 * time.Second); err != nil {
+		test.Fatal("LockWithTimeout() of released file:", err)
+	}
+}
+
+func TestDirLock(test *testing.T) {
+	dir, err := ioutil.TempDir("", "daemon")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	lock := NewDirLock(filepath.Join(dir, "lock"))
+	if _, err = lock.Owner(); err != ErrNotLocked {
+		test.Fatal("Owner() of absent lock:", err)
+	}
+
+	if err = lock.TryLock(os.Getpid()); err != nil {
+		test.Fatal(err)
+	}
+	if pid, err := lock.Owner(); pid != os.Getpid() || err != nil {
+		test.Fatal("Owner():", pid, err)
+	}
+	if err = lock.TryLock(os.Getpid()); err != ErrWouldBlock {
+		test.Fatal("TryLock() of held lock: expected ErrWouldBlock, got", err)
+	}
+
+	// the owner has exited, concurrent processes take over the stale lock
+	if err = lock.SetOwner(deadPid(test)); err != nil {
+		test.Fatal(err)
+	}
+	results := make(chan error, 10)
+	for i := 0; i < cap(results); i++ {
+		go func() {
+			results <- NewDirLock(lock.Name).TryLock(os.Getpid())
+		}()
+	}
+	locked := 0
+	for i := 0; i < cap(results); i++ {
+		if err := <-results; err == nil {
+			locked++
+		} else if err != ErrWouldBlock {
+			test.Error("TryLock() of stale lock:", err)
+		}
+	}
+	if locked != 1 {
+		test.Fatal("stale lock is taken over times:", locked)
+	}
+	if pid, err := lock.Owner(); pid != os.Getpid() || err != nil {
+		test.Fatal("Owner() of taken over lock:", pid, err)
+	}
+
+	if err = lock.Unlock(); err != nil {
+		test.Fatal(err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		test.Fatal("lock is left after Unlock:", names)
+	}
+
+	// the owner has not written its pid yet
+	if err = os.Mkdir(lock.Name, 0755); err != nil {
+		test.Fatal(err)
+	}
+	if err = lock.TryLock(os.Getpid()); err != ErrWouldBlock {
+		test.Fatal("TryLock() of lock without pid: expected ErrWouldBlock, got", err)
+	}
+}
+
 func TestReadPid(test *testing.T) {
 	lock, err := CreatePidFile(filename, fileperm)
 	if err != nil {
@@ -88,6 +288,168 @@ func TestReadPid(test *testing.T) {
 	}
 }
 
+func TestPidInfo(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+
+	info := map[string]string{"version": "1.2.3", "build": "a=b c", "start": "0"}
+	if err = lock.WritePidInfo(info); err != nil {
+		test.Fatal(err)
+	}
+	pid, read, err := ReadPidInfo(filename)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if pid != os.Getpid() || read["version"] != "1.2.3" || read["build"] != "a=b c" {
+		test.Fatalf("ReadPidInfo(): %d, %q", pid, read)
+	}
+	if start, err := processStartToken(os.Getpid()); err != nil || read["start"] != start {
+		test.Fatalf("ReadPidInfo(): start %q, expected %q, %v", read["start"], start, err)
+	}
+	if _, ok := read["size"]; ok {
+		test.Fatalf("ReadPidInfo(): size is returned: %q", read)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if isPartialPid(data) || !strings.Contains(string(data), fmt.Sprintf("\nsize=%d\n", len(data))) {
+		test.Fatalf("WritePidInfo(): invalid size of %q", data)
+	}
+
+	if host, err := ReadPidHost(filename); err != nil || len(host) != 0 {
+		test.Fatalf("ReadPidHost(): %q, %v", host, err)
+	}
+	if err = lock.WritePidInfo(map[string]string{"host": "node1"}); err != nil {
+		test.Fatal(err)
+	}
+	if host, err := ReadPidHost(filename); err != nil || host != "node1" {
+		test.Fatalf("ReadPidHost(): %q, %v", host, err)
+	}
+
+	// readers of older versions take the first line
+	if pid, err = ReadPidFile(filename); err != nil || pid != os.Getpid() {
+		test.Fatal("ReadPidFile():", pid, err)
+	}
+	if pid, err = lock.ReadPid(); err != nil || pid != os.Getpid() {
+		test.Fatal("ReadPid():", pid, err)
+	}
+
+	for _, invalid := range []map[string]string{{"": "x"}, {"a=b": "x"}, {"a\nb": "x"}, {"a": "x\ny"}} {
+		if err = lock.WritePidInfo(invalid); err == nil {
+			test.Errorf("WritePidInfo(%q): Error was not detected", invalid)
+		}
+	}
+}
+
+func TestReadPidFileFormat(test *testing.T) {
+	contents := map[string]int{
+		" 1234\r\n":              1234,
+		"1234\n":                 1234,
+		"  1234  ":               1234,
+		"1234\nstart=5678\n":     1234,
+		"1234\r\nstart=5678\r\n": 1234,
+		"":                       0,
+		"\n1234\n":               0,
+		"12 34\n":                0,
+		"1234abc\n":              0,
+		"-1234\n":                0,
+		"0\n":                    0,
+	}
+	for content, expected := range contents {
+		if err := ioutil.WriteFile(filename, []byte(content), fileperm); err != nil {
+			test.Fatal(err)
+		}
+		pid, err := ReadPidFile(filename)
+		if expected == 0 && err == nil {
+			test.Errorf("ReadPidFile(%q): Error was not detected, pid: %d", content, pid)
+		} else if expected != 0 && (err != nil || pid != expected) {
+			test.Errorf("ReadPidFile(%q): %d, %v", content, pid, err)
+		}
+	}
+	os.Remove(filename)
+}
+
+func TestIsPartialPid(test *testing.T) {
+	contents := map[string]bool{
+		"":                                 true,
+		"1234":                             false,
+		"1234\n":                           false,
+		"1234\nstart=5678\n":               false,
+		"1234\r\nstart=5678\r\n":           false,
+		"1234\ns":                          true,
+		"1234\nsize=2":                     true,
+		"1234\nsize=25\nstart=5678\n":      true,
+		"1234\nsize=24\nstart=5678\n":      false,
+		"1234\nsize=28\nstart=5678\nv=1\n": false,
+	}
+	for content, expected := range contents {
+		if partial := isPartialPid([]byte(content)); partial != expected {
+			test.Errorf("isPartialPid(%q): %v", content, partial)
+		}
+	}
+
+	// a file of older version is read at once
+	if err := ioutil.WriteFile(filename, []byte("1234"), fileperm); err != nil {
+		test.Fatal(err)
+	}
+	defer os.Remove(filename)
+	start := time.Now()
+	if pid, err := ReadPidFile(filename); err != nil || pid != 1234 {
+		test.Fatal("ReadPidFile():", pid, err)
+	}
+	if elapsed := time.Since(start); elapsed >= readPidInterval {
+		test.Error("ReadPidFile(): file of older version is read again, elapsed", elapsed)
+	}
+}
+
+func TestReadPidFileConcurrent(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer lock.Remove()
+	if _, err = lock.WriteAt([]byte("99999999\n"), 0); err != nil {
+		test.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			if err := lock.WritePid(); err != nil {
+				test.Error(err)
+				return
+			}
+			runtime.Gosched()
+		}
+	}()
+
+	written := false
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		pid, err := ReadPidFile(filename)
+		if err != nil {
+			test.Error("ReadPidFile():", err)
+		} else if pid == os.Getpid() {
+			written = true
+		} else if written || pid != 99999999 {
+			test.Error("ReadPidFile(): unexpected pid", pid)
+		}
+		if test.Failed() {
+			<-done
+			return
+		}
+	}
+}
+
 func TestLockFileLock(test *testing.T) {
 	lock, err := OpenLockFile(filename, fileperm)
 	if err != nil {
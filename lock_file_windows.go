@@ -0,0 +1,78 @@
+package daemon
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	_LOCKFILE_FAIL_IMMEDIATELY = 0x00000001
+	_LOCKFILE_EXCLUSIVE_LOCK   = 0x00000002
+)
+
+// Windows locks are mandatory, so the lock is applied to a single byte far
+// beyond the end of file. It keeps the pid readable by other processes.
+const lockOffsetHigh = 0x7fffffff
+
+var (
+	// ErrWoldBlock indicates on locking pid-file by another process.
+	ErrWouldBlock error = syscall.Errno(33) // ERROR_LOCK_VIOLATION
+)
+
+// Lock apply exclusive lock on an open file. If file already locked, returns error.
+func (file *LockFile) Lock() error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procLockFileEx.Call(file.Fd(),
+		_LOCKFILE_EXCLUSIVE_LOCK|_LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// lockShared applies shared lock on an open file, which conflicts only
+// with the exclusive lock. If file is locked exclusively, returns error.
+func (file *LockFile) lockShared() error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procLockFileEx.Call(file.Fd(),
+		_LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Unlock removes exclusive lock on an open file. Unlike Remove, the file
+// is neither closed nor removed, so the lock may be applied again, e.g. once
+// another process, which took over the pid file, releases it.
+func (file *LockFile) Unlock() error {
+	ol := syscall.Overlapped{OffsetHigh: lockOffsetHigh}
+	r, _, err := procUnlockFileEx.Call(file.Fd(), 0, 1, 0,
+		uintptr(unsafe.Pointer(&ol)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// Remove removes lock, closes and removes an open file.
+func (file *LockFile) Remove() error {
+	if err := file.Unlock(); err != nil {
+		file.Close()
+		return err
+	}
+	// an open file can not be removed on Windows
+	name := file.Name()
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errReExec indicates that ReExec is called outside of the daemon-process
+// or in new pid namespace, where the daemon-process can not be replaced.
+var errReExec = errors.New("ReExec requires the daemon-process outside of new pid namespace")
+
+// ReExec replaces the daemon-process by a new copy of the program, e.g.
+// an upgraded binary at ExecPath or at the path of the running executable,
+// which keeps the pid file and ExtraFiles, e.g. listening sockets. It is
+// called in the daemon-process initialized by Reborn of the context.
+// The new copy runs Reborn as usual, but Chroot, WorkDir, Credential and
+// the other process attributes are inherited, so OnPrivileged is not called.
+// Once the new copy calls NotifyReady, the old process exits with status 0.
+// Otherwise the old process keeps running and holding the pid file, and
+// ReExec returns error, which wraps ErrNotReady, if the new copy fails.
+//
+// The lock of the pid file is never released meanwhile. The new copy inherits
+// the descriptor with the lock and locks it again, the old process closes it
+// on exit. It is not unlocked by the old process, since the lock belongs to
+// the open file, which both processes share, rather than to a process.
+func (d *Context) ReExec() (err error) {
+	if !daemonReady || d.newPIDNamespace() {
+		return errReExec
+	}
+	if err = d.prepareEnv(); err != nil {
+		return
+	}
+
+	var rpipe, wpipe, ready, readyWpipe *os.File
+	if rpipe, wpipe, err = os.Pipe(); err != nil {
+		return
+	}
+	defer wpipe.Close()
+	if ready, readyWpipe, err = os.Pipe(); err != nil {
+		rpipe.Close()
+		return
+	}
+	defer ready.Close()
+
+	// the layout of files is the same as of Reborn
+	pidFile := os.Stdin // placeholder of pid file
+	if d.pidFile != nil {
+		pidFile = d.pidFile.File
+	}
+	files := []*os.File{rpipe, os.Stdout, os.Stderr, os.Stdin, pidFile}
+	files = append(files, d.ExtraFiles...)
+	files = append(files, d.listenFiles...)
+	files = append(files, readyWpipe)
+
+	child, err := os.StartProcess(d.abspath, d.argv(), &os.ProcAttr{Env: d.Env, Files: files})
+	rpipe.Close()
+	readyWpipe.Close()
+	if err != nil {
+		return
+	}
+	if err = json.NewEncoder(wpipe).Encode(config{Context: d, ExtraFilesNum: len(d.ExtraFiles), ListenNames: d.listenNames(), ReExec: true}); err == nil {
+		err = readReady(ready)
+	}
+	if err == nil {
+		os.Exit(0)
+	}
+
+	if err == ErrNotReady {
+		// the new copy has exited, its status tells why
+		if state, e := child.Wait(); e == nil {
+			err = fmt.Errorf("%w: %v", ErrNotReady, state)
+		}
+	} else {
+		child.Kill()
+		go child.Wait()
+	}
+	// the new copy may have written its pid
+	if d.pidFile != nil {
+		if info, e := d.pidFileInfo(); e == nil {
+			d.pidFile.WritePidInfo(info)
+		}
+	}
+	if d.dirLock != nil {
+		d.dirLock.SetOwner(os.Getpid())
+	}
+	return
+}
@@ -48,6 +48,80 @@ func ServeSignals() (err error) {
 	return
 }
 
+// ServeSignals calls the handler registered for each received signal in
+// the daemon-process. SIGTERM and SIGINT stop serving: the handler of the
+// signal, if any, is called, then OnStop, then the pid file is released
+// and ServeSignals returns. Serving also stops when a handler returns error.
+//
+// Signals received while a handler runs are queued. With QueueSignals SIGHUP
+// is queued from Reborn on, so SIGHUP received before ServeSignals is called
+// is served first rather than lost, and it never terminates the
+// daemon-process meanwhile. The pid file stays open and locked on the same descriptor
+// during serving, so e.g. a SIGHUP handler may reload configuration without
+// locking the pid file again.
+func (d *Context) ServeSignals(handlers map[syscall.Signal]func() error) (err error) {
+	signals := []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	for sig := range handlers {
+		signals = append(signals, sig)
+	}
+
+	ch := make(chan os.Signal, 8)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+
+	for _, sig := range takeQueuedSignals() {
+		if done, err := d.serveSignal(handlers, sig); done {
+			return err
+		}
+	}
+	for sig := range ch {
+		if done, err := d.serveSignal(handlers, sig); done {
+			return err
+		}
+	}
+	return
+}
+
+// serveSignal calls the handler of sig and reports whether serving stops.
+func (d *Context) serveSignal(handlers map[syscall.Signal]func() error, sig os.Signal) (done bool, err error) {
+	if handler := handlers[sig.(syscall.Signal)]; handler != nil {
+		if err = handler(); err != nil {
+			return true, err
+		}
+	}
+	if sig == syscall.SIGTERM || sig == syscall.SIGINT {
+		d.stop()
+		return true, d.Release()
+	}
+	return
+}
+
+// queuedSignals receives SIGHUP in the daemon-process from Reborn on, if
+// QueueSignals is set, until ServeSignals takes over, see queueSignals.
+var queuedSignals chan os.Signal
+
+// queueSignals starts queueing of SIGHUP in the daemon-process, which is
+// initialized by Reborn with QueueSignals. Otherwise SIGHUP, e.g. a reload requested right after
+// start, kills the daemon-process, before it calls ServeSignals.
+func queueSignals() {
+	queuedSignals = make(chan os.Signal, 8)
+	signal.Notify(queuedSignals, syscall.SIGHUP)
+}
+
+// takeQueuedSignals stops queueing of signals and returns the queued ones.
+// It is called once ServeSignals receives the signals itself.
+func takeQueuedSignals() (signals []os.Signal) {
+	if queuedSignals == nil {
+		return
+	}
+	signal.Stop(queuedSignals)
+	for len(queuedSignals) > 0 {
+		signals = append(signals, <-queuedSignals)
+	}
+	queuedSignals = nil
+	return
+}
+
 var handlers = make(map[os.Signal]SignalHandlerFunc)
 
 func init() {
@@ -0,0 +1,139 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Environment variable, which makes a copy of the program the worker
+// process of Supervise.
+const workerEnvName = "_GO_DAEMON_WORKER"
+
+// ErrRestartLimit indicates that the worker of Supervise failed more times
+// than RestartPolicy allows.
+var ErrRestartLimit = errors.New("daemon restarted too many times")
+
+// RestartPolicy describes how Supervise restarts the failed worker.
+type RestartPolicy struct {
+	// MaxRestarts limits the number of restarts, Supervise gives up once
+	// the worker fails again. If it is negative, the worker is restarted
+	// unboundedly.
+	MaxRestarts int
+	// Backoff is the delay before the first restart. It doubles after each
+	// restart, but does not exceed MaxBackoff, if it is non-zero. The delay
+	// is never less than 100ms, so the worker, which fails at once, is not
+	// restarted in a busy loop.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// minRestartBackoff is the least delay before a restart of the worker.
+const minRestartBackoff = 100 * time.Millisecond
+
+// Supervise is like Daemonize, but keeps the daemon alive. The daemon-process
+// is a supervisor, which holds the pid file and runs run in a worker process,
+// a copy of the program with the same args. If run returns error, i.e. the
+// worker exits with non-zero status, the worker is restarted according to
+// policy. Supervise returns nil, once the worker exits with zero status or
+// the supervisor is stopped by SIGTERM or SIGINT, which stops the worker by
+// StopSignal first. Otherwise it returns error wrapping ErrRestartLimit.
+//
+// Supervise is called by the worker as well, so the program must call it
+// before doing other work. In the worker Supervise calls run and exits:
+// with status 0 if run returns nil, otherwise run's error is printed
+// to stderr and the status is 1. The worker writes into the stdout and
+// stderr of the daemon-process.
+func (d *Context) Supervise(run func() error, policy RestartPolicy) (err error) {
+	if os.Getenv(workerEnvName) == "1" {
+		if err = run(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	var child *os.Process
+	if child, err = d.Reborn(); err != nil || child != nil {
+		return
+	}
+	defer d.Release()
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(ch)
+
+	backoff := policy.Backoff
+	for restarts := 0; ; restarts++ {
+		var worker *os.Process
+		if worker, err = d.startWorker(); err != nil {
+			return
+		}
+		done := make(chan error, 1)
+		go func() {
+			state, err := worker.Wait()
+			if err == nil && !state.Success() {
+				err = errors.New(state.String())
+			}
+			done <- err
+		}()
+
+		select {
+		case <-ch:
+			d.stopWorker(worker, done)
+			return nil
+		case err = <-done:
+		}
+		if err == nil {
+			return
+		}
+		if policy.MaxRestarts >= 0 && restarts >= policy.MaxRestarts {
+			return fmt.Errorf("%w: worker %v after %d restarts", ErrRestartLimit, err, restarts)
+		}
+
+		if backoff < minRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		select {
+		case <-ch:
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// startWorker starts the worker process of Supervise.
+func (d *Context) startWorker() (*os.Process, error) {
+	path, err := GetExecPath(os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	attr := &os.ProcAttr{
+		Env:   append(os.Environ(), workerEnvName+"=1"),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr},
+	}
+	return os.StartProcess(path, d.Args, attr)
+}
+
+// stopWorker sends StopSignal to the worker and waits until it exits. If
+// StopTimeout is non-zero and the worker does not exit in time, it is killed.
+func (d *Context) stopWorker(worker *os.Process, done <-chan error) {
+	if err := sendSignal(worker, d.stopSignal()); err != nil {
+		return
+	}
+	if d.StopTimeout > 0 {
+		select {
+		case <-done:
+			return
+		case <-time.After(d.StopTimeout):
+			worker.Kill()
+		}
+	}
+	<-done
+}
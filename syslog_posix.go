@@ -0,0 +1,113 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log/syslog"
+	"os"
+	"syscall"
+)
+
+// errSyslog indicates conflicting options of daemon output.
+var errSyslog = errors.New("UseSyslog excludes LogFileName and StderrFileName")
+
+// Environment variable, which passes syslog settings to the forwarder process.
+const syslogEnvName = "_GO_DAEMON_SYSLOG"
+
+// syslogConfig describes the connection of the forwarder process to syslog.
+type syslogConfig struct {
+	Network  string
+	Addr     string
+	Tag      string
+	Priority syslog.Priority
+}
+
+func init() {
+	// The forwarder process is a copy of the program, so it must be caught
+	// before the program runs any code.
+	if conf := os.Getenv(syslogEnvName); len(conf) > 0 {
+		os.Exit(forwardSyslog(conf))
+	}
+}
+
+// forwardSyslog writes lines from stdin into syslog until EOF.
+func forwardSyslog(conf string) int {
+	var c syslogConfig
+	if err := json.Unmarshal([]byte(conf), &c); err != nil {
+		io.Copy(ioutil.Discard, os.Stdin)
+		return 2
+	}
+	w, err := syslog.Dial(c.Network, c.Addr, c.Priority, c.Tag)
+	if err != nil {
+		// drain the pipe, otherwise the daemon gets SIGPIPE
+		io.Copy(ioutil.Discard, os.Stdin)
+		return 1
+	}
+	defer w.Close()
+
+	r := bufio.NewReader(os.Stdin)
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			w.Write(line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	return 0
+}
+
+// startSyslog checks the connection to syslog and starts the forwarder
+// process. Returns the write end of the pipe to the forwarder.
+func (d *Context) startSyslog() (w *os.File, err error) {
+	facility := d.SyslogFacility
+	if facility == 0 {
+		facility = syslog.LOG_DAEMON
+	}
+	c := syslogConfig{d.SyslogNetwork, d.SyslogAddr, d.SyslogTag, facility | syslog.LOG_INFO}
+
+	var s *syslog.Writer
+	if s, err = syslog.Dial(c.Network, c.Addr, c.Priority, c.Tag); err != nil {
+		return
+	}
+	s.Close()
+
+	var conf []byte
+	if conf, err = json.Marshal(c); err != nil {
+		return
+	}
+	var r *os.File
+	if r, w, err = os.Pipe(); err != nil {
+		return
+	}
+	defer r.Close()
+
+	attr := &os.ProcAttr{
+		Env:   append(os.Environ(), syslogEnvName+"="+string(conf)),
+		Files: []*os.File{r, d.nullFile, d.nullFile},
+		Sys: &syscall.SysProcAttr{
+			Setsid: true,
+		},
+	}
+	if d.forwarder, err = os.StartProcess(d.abspath, d.Args[:1], attr); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return
+}
+
+// reapForwarder waits for the syslog forwarder started by the last Reborn,
+// which exits once the daemon-process closes its output.
+func (d *Context) reapForwarder() {
+	if d.forwarder != nil {
+		d.forwarder.Wait()
+		d.forwarder = nil
+	}
+}
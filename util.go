@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"errors"
+	"path/filepath"
+	"time"
+)
+
+// ErrNoProc is returned by GetExecPath, if the proc filesystem is not
+// mounted, e.g. in a minimal container or chroot. IsProcessRunning falls
+// back to a degraded check then.
+var ErrNoProc = errors.New("proc filesystem is not available")
+
+// matchExec reports whether exe_path is the executable exe, which is given
+// either by path or by base name.
+func matchExec(exe_path, exe string) bool {
+	if filepath.Base(exe) == exe {
+		return filepath.Base(exe_path) == exe
+	}
+	return exe_path == filepath.Clean(exe)
+}
+
+// PidFileWindow is the maximal difference between the start time of
+// the process and the modification time of pid file, which IsProcessRunningAs
+// accepts, if the process runs another executable, e.g. the binary of
+// the daemon is replaced and the pid file has no start time.
+var PidFileWindow = time.Minute
+
+// isPidFileFresh reports whether the pid file modified at pidModTime is
+// written by the process started at procStartTime, i.e. soon after its start,
+// so the pid is not reused. The times differ less than window then.
+func isPidFileFresh(pidModTime, procStartTime time.Time, window time.Duration) bool {
+	diff := pidModTime.Sub(procStartTime)
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff < window
+}
+
+// matchStart compares the start time of the process with the one recorded
+// in the pid file. Returns ok false if the pid file has no start time.
+func matchStart(pid int, pidfile string) (match, ok bool) {
+	_, info, err := ReadPidInfo(pidfile)
+	if err != nil {
+		return false, false
+	}
+	start, ok := info[pidStartKey]
+	if !ok {
+		return false, false
+	}
+	token, err := processStartToken(pid)
+	return err == nil && token == start, true
+}
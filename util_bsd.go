@@ -0,0 +1,76 @@
+//go:build darwin || freebsd
+// +build darwin freebsd
+
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// Management information base names, see sysctl(3).
+const (
+	_CTL_KERN      = 1
+	_KERN_PROC     = 14
+	_KERN_PROC_PID = 1
+)
+
+// processStartToken returns the start time of the process, which
+// identifies the process together with pid.
+func processStartToken(pid int) (string, error) {
+	start, err := processStartTime(pid)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(start.UnixNano(), 10), nil
+}
+
+// listPids is not supported.
+func listPids() ([]int, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// lockOwner is not supported.
+func lockOwner(fi os.FileInfo) (int, error) {
+	return 0, syscall.ENOTSUP
+}
+
+// processEnv is not supported.
+func processEnv(pid int) ([]string, error) {
+	return nil, syscall.ENOTSUP
+}
+
+// setProcessName does nothing, the command name is the name of executable.
+func setProcessName(name string) error {
+	return nil
+}
+
+// setOOMScoreAdj is not supported.
+func setOOMScoreAdj(adj int) error {
+	return syscall.ENOTSUP
+}
+
+// sysctl returns the value of the system variable with given mib.
+func sysctl(mib []int32) ([]byte, error) {
+	var size uintptr
+	if err := rawSysctl(mib, nil, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if err := rawSysctl(mib, &buf[0], &size); err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+func rawSysctl(mib []int32, old *byte, oldlen *uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS___SYSCTL,
+		uintptr(unsafe.Pointer(&mib[0])), uintptr(len(mib)),
+		uintptr(unsafe.Pointer(old)), uintptr(unsafe.Pointer(oldlen)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
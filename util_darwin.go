@@ -0,0 +1,42 @@
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const _KERN_PROCARGS2 = 49
+
+// GetExecPath returns the path of executable file of the process.
+func GetExecPath(pid int) (string, error) {
+	// KERN_PROCARGS2 starts with argc followed by the exec path
+	buf, err := sysctl([]int32{_CTL_KERN, _KERN_PROCARGS2, int32(pid)})
+	if err != nil {
+		return "", err
+	}
+	if len(buf) <= 4 {
+		return "", errors.New("invalid process arguments")
+	}
+	buf = buf[4:]
+	if i := bytes.IndexByte(buf, 0); i >= 0 {
+		buf = buf[:i]
+	}
+	return string(buf), nil
+}
+
+// processStartTime returns the process start time from kinfo_proc,
+// which starts with extern_proc.p_starttime.
+func processStartTime(pid int) (time.Time, error) {
+	buf, err := sysctl([]int32{_CTL_KERN, _KERN_PROC, _KERN_PROC_PID, int32(pid)})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(buf) < int(unsafe.Sizeof(syscall.Timeval{})) {
+		return time.Time{}, syscall.ESRCH
+	}
+	tv := (*syscall.Timeval)(unsafe.Pointer(&buf[0]))
+	return time.Unix(tv.Unix()), nil
+}
@@ -0,0 +1,58 @@
+package daemon
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const _KERN_PROC_PATHNAME = 12
+
+// kinfoProc is the head of struct kinfo_proc from sys/user.h,
+// up to the ki_start field.
+type kinfoProc struct {
+	structsize, layout                int32
+	args, paddr, addr, tracep, textvp uintptr
+	fd, vmspace, wchan                uintptr
+	pid, ppid, pgid, tpgid, sid, tsid int32
+	jobc, spareShort1                 int16
+	tdev                              uint32
+	siglist, sigmask                  [4]uint32
+	sigignore, sigcatch               [4]uint32
+	uid, ruid, svuid, rgid, svgid     uint32
+	ngroups, spareShort2              int16
+	groups                            [16]uint32
+	size, rssize, swrss               uintptr
+	tsize, dsize, ssize               uintptr
+	xstat, acflag                     uint16
+	pctcpu, estcpu, slptime, swtime   uint32
+	cow                               uint32
+	runtime                           uint64
+	start                             syscall.Timeval
+}
+
+// GetExecPath returns the path of executable file of the process.
+func GetExecPath(pid int) (string, error) {
+	buf, err := sysctl([]int32{_CTL_KERN, _KERN_PROC, _KERN_PROC_PATHNAME, int32(pid)})
+	if err != nil {
+		return "", err
+	}
+	// the value is nul-terminated
+	if n := len(buf); n > 0 && buf[n-1] == 0 {
+		buf = buf[:n-1]
+	}
+	return string(buf), nil
+}
+
+// processStartTime returns the process start time from kinfo_proc.ki_start.
+func processStartTime(pid int) (time.Time, error) {
+	buf, err := sysctl([]int32{_CTL_KERN, _KERN_PROC, _KERN_PROC_PID, int32(pid)})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(buf) < int(unsafe.Sizeof(kinfoProc{})) {
+		return time.Time{}, syscall.ESRCH
+	}
+	kp := (*kinfoProc)(unsafe.Pointer(&buf[0]))
+	return time.Unix(kp.start.Unix()), nil
+}
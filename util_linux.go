@@ -0,0 +1,106 @@
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// forEachThread calls f for each thread of the process. The nice value and
+// CPU affinity belong to threads on Linux, and a new thread inherits them
+// from the thread, which creates it, so the threads started meanwhile are
+// listed again, until no more are found.
+func forEachThread(f func(tid int) error) error {
+	done := make(map[int]bool)
+	for {
+		dir, err := os.Open("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		names, err := dir.Readdirnames(-1)
+		dir.Close()
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, name := range names {
+			tid, err := strconv.Atoi(name)
+			if err != nil || done[tid] {
+				continue
+			}
+			// the thread may have exited
+			if err = f(tid); err != nil && err != syscall.ESRCH {
+				return err
+			}
+			done[tid], found = true, true
+		}
+		if !found {
+			return nil
+		}
+	}
+}
+
+// setNice sets the nice value of all threads of the process.
+func setNice(nice int) error {
+	return forEachThread(func(tid int) error {
+		return syscall.Setpriority(syscall.PRIO_PROCESS, tid, nice)
+	})
+}
+
+// setAffinity binds all threads of the process to the CPUs with given
+// numbers.
+func setAffinity(cpus []int) error {
+	var mask []uint64
+	for _, cpu := range cpus {
+		if cpu < 0 {
+			return syscall.EINVAL
+		}
+		for len(mask) <= cpu/64 {
+			mask = append(mask, 0)
+		}
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	return forEachThread(func(tid int) error {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, uintptr(tid),
+			uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+}
+
+// Flag of clone(2), which creates new pid namespace.
+const cloneNewPID = syscall.CLONE_NEWPID
+
+// Flags of clone(2), which create new namespaces, except user namespace,
+// which requires mappings of ids.
+const cloneNewNamespaces = syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS |
+	syscall.CLONE_NEWIPC | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET |
+	syscall.CLONE_NEWCGROUP
+
+// setCloneflags sets flags of clone(2) for the process started with attr,
+// which create new namespaces.
+func setCloneflags(attr *syscall.SysProcAttr, flags uintptr, newPID bool) error {
+	if flags&^cloneNewNamespaces != 0 {
+		return errCloneflags
+	}
+	if newPID {
+		flags |= syscall.CLONE_NEWPID
+	}
+	attr.Cloneflags |= flags
+	return nil
+}
+
+// setAmbientCaps makes the process started with attr keep the given
+// capabilities in the ambient set.
+func setAmbientCaps(attr *syscall.SysProcAttr, caps []uintptr) error {
+	attr.AmbientCaps = caps
+	return nil
+}
+
+// unlinkAt removes the file with given name in the open directory.
+func unlinkAt(dir *os.File, name string) error {
+	return syscall.Unlinkat(int(dir.Fd()), name)
+}
@@ -0,0 +1,103 @@
+package daemon
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func init() {
+	// hostname changes hostname and prints it
+	helpers["hostname"] = func(d *Context) error {
+		if err := syscall.Sethostname([]byte("go-daemon-test")); err != nil {
+			return err
+		}
+		name, err := os.Hostname()
+		fmt.Println(name)
+		return err
+	}
+	// bind prints whether it can listen on port 80 and its uid
+	helpers["bind"] = func(d *Context) error {
+		ln, err := net.Listen("tcp", "127.0.0.1:80")
+		if err == nil {
+			ln.Close()
+		}
+		fmt.Println(err == nil, os.Getuid())
+		return nil
+	}
+}
+
+func TestCloneflags(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		test.Fatal(err)
+	}
+	dmn := newTestContext(test, "hostname")
+	dmn.Cloneflags = syscall.CLONE_NEWUTS
+	child := startHelper(test, dmn)
+	child.Wait()
+	waitLog(test, dmn, "go-daemon-test\n")
+	if name, _ := os.Hostname(); name != host {
+		test.Fatalf("hostname of host was changed to %q", name)
+	}
+
+	dmn = newTestContext(test, "pid")
+	dmn.Cloneflags = syscall.CLONE_NEWPID
+	dmn.DoubleFork = true
+	if _, err = dmn.Reborn(); err != errPIDNamespace {
+		test.Fatal("Reborn(): expected errPIDNamespace, got", err)
+	}
+
+	dmn = newTestContext(test, "pid")
+	dmn.Cloneflags = syscall.CLONE_VM
+	if _, err = dmn.Reborn(); err != errCloneflags {
+		test.Fatal("Reborn(): expected errCloneflags, got", err)
+	}
+}
+
+func TestCapabilities(test *testing.T) {
+	if os.Getuid() != 0 {
+		test.Skip("requires root")
+	}
+	u, err := user.Lookup("daemon")
+	if err != nil {
+		test.Skip(err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	ln, err := net.Listen("tcp", "127.0.0.1:80")
+	if err != nil {
+		test.Skip(err)
+	}
+	ln.Close()
+
+	const capNetBindService = 10
+	for _, caps := range [][]uintptr{nil, {capNetBindService}} {
+		dmn := newTestContext(test, "bind")
+		dmn.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+		dmn.Capabilities = caps
+		// the user executes the binary itself
+		dir := filepath.Dir(dmn.PidFileName)
+		if err = os.Chmod(dir, 0755); err != nil {
+			test.Fatal(err)
+		}
+		dmn.ExecPath = copyExec(test, dir)
+		child := startHelper(test, dmn)
+		child.Wait()
+		waitLog(test, dmn, fmt.Sprintln(caps != nil, uid))
+	}
+
+	dmn := newTestContext(test, "bind")
+	dmn.Capabilities = []uintptr{capNetBindService}
+	if _, err = dmn.Reborn(); err != errCapabilities {
+		test.Fatal("Reborn(): expected errCapabilities, got", err)
+	}
+}
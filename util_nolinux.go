@@ -0,0 +1,40 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+// setNice sets the nice value of the process.
+func setNice(nice int) error {
+	return syscall.Setpriority(syscall.PRIO_PROCESS, 0, nice)
+}
+
+// setAffinity is not supported.
+func setAffinity(cpus []int) error {
+	return syscall.ENOTSUP
+}
+
+// Namespaces are not supported.
+const cloneNewPID = 0
+
+// setCloneflags does not support namespaces.
+func setCloneflags(attr *syscall.SysProcAttr, flags uintptr, newPID bool) error {
+	if flags != 0 || newPID {
+		return syscall.ENOTSUP
+	}
+	return nil
+}
+
+// setAmbientCaps is not supported.
+func setAmbientCaps(attr *syscall.SysProcAttr, caps []uintptr) error {
+	return syscall.ENOTSUP
+}
+
+// unlinkAt is not supported.
+func unlinkAt(dir *os.File, name string) error {
+	return syscall.ENOTSUP
+}
@@ -1,33 +1,131 @@
+//go:build !windows
+// +build !windows
+
 package daemon
 
 import (
+	"fmt"
 	"os"
-	"math"
 	"strings"
-	"fmt"
+	"syscall"
+	"time"
+)
+
+// Modes of access(2) missing in package syscall.
+const (
+	_X_OK = 0x1
+	_W_OK = 0x2
 )
 
-//return
-func GetExecPath(pid int) (string, error) {
-	proc_exe_link := fmt.Sprintf("/proc/%d/exe", pid)
-	link_target, err := os.Readlink(proc_exe_link)
-	if err != nil {
-		return "", err
+// checkWritable reports whether files can be created in the directory.
+func checkWritable(dir string) error {
+	if err := syscall.Access(dir, _W_OK|_X_OK); err != nil {
+		return &os.PathError{Op: "access", Path: dir, Err: err}
 	}
-	link_target = strings.TrimSuffix(link_target, " (deleted)") //if exe file is replace
-	return link_target, nil
+	return nil
 }
 
-func IsProcessRunning(pid int, pidfiles... string) bool {
-	my_path, err := GetExecPath(os.Getpid())
-	if err != nil {
+// checkPidFileOwner reports the existing pid file, which is owned by another
+// user than the effective user of the current process or given owners, e.g.
+// of the daemon of another user with the same PidFileName.
+func checkPidFileOwner(name string, owners ...int) error {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || int(st.Uid) == os.Geteuid() {
+		return nil
+	}
+	for _, uid := range owners {
+		if int(st.Uid) == uid {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is owned by uid %d", ErrPidFileOwner, name, st.Uid)
+}
+
+// trimDeleted removes the suffix which the kernel appends to the link
+// target when the executable file is replaced or deleted.
+func trimDeleted(link_target string) string {
+	return strings.TrimSuffix(link_target, " (deleted)")
+}
+
+// processExists reports whether the process with given pid exists.
+func processExists(pid int) bool {
+	return syscall.Kill(pid, 0) != syscall.ESRCH
+}
+
+// reapChild reaps the exiting process, if it is a child of the current
+// process, e.g. the daemon-process started by Reborn, and releases p.
+// wait4(2) fails with ECHILD for other processes and for the child, which
+// is waited for elsewhere. The child is waited for without blocking, since
+// it may be not waitable yet, but no longer than until deadline, if it is
+// non-zero.
+func reapChild(p *os.Process, deadline time.Time) {
+	defer p.Release()
+	for {
+		var status syscall.WaitStatus
+		pid, err := syscall.Wait4(p.Pid, &status, syscall.WNOHANG, nil)
+		if pid != 0 || (err != nil && err != syscall.EINTR) {
+			return
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// isAliveLocking reports whether the process with given pid is alive and
+// the pid file, if given, is locked, i.e. by the process.
+func isAliveLocking(pid int, pidfiles ...string) bool {
+	if err := syscall.Kill(pid, 0); err != nil && err != syscall.EPERM {
 		return false
 	}
+	if len(pidfiles) == 0 {
+		return true
+	}
+	return isFileLocked(pidfiles[0])
+}
+
+// IsProcessRunning reports whether the process with given pid is alive and
+// runs the same executable as the current process, see IsProcessRunningAs.
+func IsProcessRunning(pid int, pidfiles ...string) bool {
+	return IsProcessRunningAs(pid, "", pidfiles...)
+}
+
+// IsProcessRunningAs reports whether the process with given pid is alive and
+// runs the executable exe, given either by path or by base name. If exe
+// is empty, the executable of the current process is used. The executable
+// of the process matches also after its file is deleted or replaced.
+// If the executables differ, the process start time is compared with
+// modification time of pid file, see PidFileWindow.
+// Without /proc the process is only checked to be alive and to hold the
+// lock of pid file, if given, see ErrNoProc.
+func IsProcessRunningAs(pid int, exe string, pidfiles ...string) bool {
 	exe_path, err := GetExecPath(pid)
-	if err != nil {
+	if err == ErrNoProc {
+		return isAliveLocking(pid, pidfiles...)
+	} else if err != nil {
 		return false
 	}
-	if my_path == exe_path {
+	if len(exe) == 0 {
+		my_path, err := GetExecPath(os.Getpid())
+		if err != nil {
+			return false
+		}
+		exe = my_path
+	}
+	if len(pidfiles) > 0 {
+		// start time recorded in pid file identifies the process exactly
+		if match, ok := matchStart(pid, pidfiles[0]); ok {
+			return match
+		}
+	}
+	if matchExec(exe_path, exe) {
 		return true
 	}
 	if len(pidfiles) > 0 {
@@ -35,12 +133,14 @@ func IsProcessRunning(pid int, pidfiles... string) bool {
 		//assume pid file created not long after process start, pid number is not reuse
 		pidfile := pidfiles[0]
 		pidfile_s, err := os.Stat(pidfile)
-		if err != nil { return false }
-		proc_stat_path := fmt.Sprintf("/proc/%d/stat", pid)
-		proc_s, err := os.Stat(proc_stat_path)
-		if err != nil { return false }
-		time_diff := pidfile_s.ModTime().Unix() - proc_s.ModTime().Unix()
-		if math.Abs(float64(time_diff)) < 60.0 {
+		if err != nil {
+			return false
+		}
+		start, err := processStartTime(pid)
+		if err != nil {
+			return false
+		}
+		if isPidFileFresh(pidfile_s.ModTime(), start, PidFileWindow) {
 			return true
 		}
 	}
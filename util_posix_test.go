@@ -0,0 +1,60 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestTrimDeleted(test *testing.T) {
+	paths := map[string]string{
+		"/opt/tool":                     "/opt/tool",
+		"/opt/tool (deleted)":           "/opt/tool",
+		"/opt/mytool-deleted":           "/opt/mytool-deleted",
+		"/usr/bin/ld":                   "/usr/bin/ld",
+		"/opt/build (old)":              "/opt/build (old)",
+		"/opt/build (old) (deleted)":    "/opt/build (old)",
+		"/opt/tool (deleted) (deleted)": "/opt/tool (deleted)",
+	}
+	for path, expected := range paths {
+		if trimmed := trimDeleted(path); trimmed != expected {
+			test.Errorf("trimDeleted(`%s'): `%s', expected `%s'", path, trimmed, expected)
+		}
+	}
+}
+
+func TestProcessStartTime(test *testing.T) {
+	start, err := processStartTime(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if start.After(time.Now()) || time.Since(start) > time.Hour {
+		test.Error("processStartTime(): unexpected start time", start)
+	}
+	if IsProcessRunning(deadPid(test)) {
+		test.Error("IsProcessRunning(): exited process is running")
+	}
+}
+
+func TestReapChild(test *testing.T) {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		test.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	p, err := os.FindProcess(cmd.Process.Pid)
+	if err != nil {
+		test.Fatal(err)
+	}
+	start := time.Now()
+	reapChild(p, start.Add(100*time.Millisecond))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		test.Error("reapChild(): running child is waited for past deadline, elapsed", elapsed)
+	}
+}
@@ -0,0 +1,217 @@
+//go:build !windows && !darwin && !freebsd
+// +build !windows,!darwin,!freebsd
+
+package daemon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Mount point of proc filesystem, it is changed by tests.
+var procRoot = "/proc"
+
+// GetExecPath returns the path of executable file of the process.
+// Returns ErrNoProc if /proc is not mounted.
+func GetExecPath(pid int) (string, error) {
+	proc_exe_link := fmt.Sprintf("%s/%d/exe", procRoot, pid)
+	link_target, err := os.Readlink(proc_exe_link)
+	if err != nil {
+		if _, e := os.Stat(procRoot + "/self"); e != nil {
+			return "", ErrNoProc
+		}
+		return "", err
+	}
+	return trimDeleted(link_target), nil
+}
+
+// listPids returns ids of all processes.
+func listPids() (pids []int, err error) {
+	var dir *os.File
+	if dir, err = os.Open(procRoot); err != nil {
+		return
+	}
+	defer dir.Close()
+	var names []string
+	if names, err = dir.Readdirnames(-1); err != nil {
+		return
+	}
+	for _, name := range names {
+		if pid, e := strconv.Atoi(name); e == nil && pid > 0 {
+			pids = append(pids, pid)
+		}
+	}
+	return
+}
+
+// processEnv returns the environment of the process at its start.
+func processEnv(pid int) ([]string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/environ", procRoot, pid))
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\x00"), "\x00"), nil
+}
+
+// Clock ticks per second of times in /proc, USER_HZ of the kernel.
+const userHZ = 100
+
+// processStartTime returns the process start time. It is computed from
+// the start time in clock ticks after system boot, see processStartToken,
+// and the time since boot of /proc/uptime.
+func processStartTime(pid int) (time.Time, error) {
+	token, err := processStartToken(pid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	ticks, err := strconv.ParseInt(token, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	data, err := ioutil.ReadFile(procRoot + "/uptime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return time.Time{}, fmt.Errorf("invalid %s/uptime", procRoot)
+	}
+	uptime, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	alive := time.Duration(uptime*float64(time.Second)) - time.Duration(ticks)*time.Second/userHZ
+	return time.Now().Add(-alive), nil
+}
+
+// processStartToken returns the start time of the process in clock ticks
+// after system boot, field 22 of /proc/<pid>/stat. It identifies
+// the process together with pid.
+func processStartToken(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%d/stat", procRoot, pid))
+	if err != nil {
+		return "", err
+	}
+	// the command name in parentheses may contain spaces
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return "", fmt.Errorf("invalid stat of process %d", pid)
+	}
+	// fields after the command name start from the third one
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22-2 {
+		return "", fmt.Errorf("invalid stat of process %d", pid)
+	}
+	return fields[22-3], nil
+}
+
+// setProcessName sets the command name of the process. Unlike
+// prctl(PR_SET_NAME), which names the calling thread, it names the main
+// thread, whose name is the name of the process.
+func setProcessName(name string) error {
+	return ioutil.WriteFile(procRoot+"/self/comm", []byte(name), 0644)
+}
+
+// setOOMScoreAdj sets OOM score adjustment of the process.
+func setOOMScoreAdj(adj int) error {
+	return ioutil.WriteFile(procRoot+"/self/oom_score_adj", []byte(strconv.Itoa(adj)), 0644)
+}
+
+// errLockHolder indicates the lock, which is held by a process invisible
+// in /proc, e.g. of another pid namespace.
+var errLockHolder = errors.New("process holding the lock is not found")
+
+// lockOwner returns pid of the process, which holds the lock of the file
+// with given info. /proc/locks gives the process, which applied the lock,
+// but the lock belongs to the open file, which may be inherited, e.g. by
+// the daemon-process from parent. So the process with a locked descriptor
+// of the file is looked up in /proc/<pid>/fdinfo.
+func lockOwner(fi os.FileInfo) (owner int, err error) {
+	id := lockFileID(fi)
+	var data []byte
+	if data, err = ioutil.ReadFile(procRoot + "/locks"); err != nil {
+		return
+	}
+	locker := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if pid, ok := parseLock(line, id); ok {
+			locker = pid
+			break
+		}
+	}
+	if locker == 0 {
+		return 0, ErrNotLocked
+	}
+	if holdsLock(locker, id) {
+		return locker, nil
+	}
+
+	var pids []int
+	if pids, err = listPids(); err != nil {
+		return
+	}
+	for _, pid := range pids {
+		if pid != locker && holdsLock(pid, id) {
+			return pid, nil
+		}
+	}
+	return 0, errLockHolder
+}
+
+// lockFileID returns the id of the file in /proc/locks, "major:minor:inode".
+func lockFileID(fi os.FileInfo) string {
+	st := fi.Sys().(*syscall.Stat_t)
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	return fmt.Sprintf("%02x:%02x:%d", major, minor, st.Ino)
+}
+
+// parseLock parses the line of /proc/locks, e.g.
+// "1: FLOCK  ADVISORY  WRITE 1234 fe:00:5678 0 EOF", and returns pid of
+// the process, which applied the lock, if the lock of the file with given
+// id is held rather than waited for.
+func parseLock(line, id string) (pid int, ok bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 6 || fields[1] == "->" || fields[5] != id {
+		return
+	}
+	pid, err := strconv.Atoi(fields[4])
+	return pid, err == nil
+}
+
+// holdsLock reports whether the process has a descriptor of the file with
+// given id, which holds the lock.
+func holdsLock(pid int, id string) bool {
+	fdinfo := fmt.Sprintf("%s/%d/fdinfo", procRoot, pid)
+	dir, err := os.Open(fdinfo)
+	if err != nil {
+		return false
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return false
+	}
+	for _, name := range names {
+		data, err := ioutil.ReadFile(fdinfo + "/" + name)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "lock:") {
+				if _, ok := parseLock(line[len("lock:"):], id); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
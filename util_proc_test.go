@@ -0,0 +1,339 @@
+//go:build !windows && !darwin && !freebsd
+// +build !windows,!darwin,!freebsd
+
+package daemon
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeProc replaces procRoot with a temporary directory, which holds
+// entries for the given pids with executable exe and the start time start.
+func fakeProc(test *testing.T, exe string, start map[int]string) {
+	root, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		test.Fatal(err)
+	}
+	saved := procRoot
+	procRoot = root
+	test.Cleanup(func() {
+		procRoot = saved
+		os.RemoveAll(root)
+	})
+
+	for pid, ticks := range start {
+		dir := filepath.Join(root, fmt.Sprint(pid))
+		if err = os.Mkdir(dir, 0755); err != nil {
+			test.Fatal(err)
+		}
+		if err = os.Symlink(exe, filepath.Join(dir, "exe")); err != nil {
+			test.Fatal(err)
+		}
+		stat := fmt.Sprintf("%d (my (pro) cess) S 1 %d %d 0 -1 4194560 "+
+			"100 0 0 0 1 2 0 0 20 0 1 0 %s 1000 100", pid, pid, pid, ticks)
+		if err = ioutil.WriteFile(filepath.Join(dir, "stat"), []byte(stat), 0644); err != nil {
+			test.Fatal(err)
+		}
+	}
+}
+
+func TestProcessStartToken(test *testing.T) {
+	fakeProc(test, "/usr/bin/tool", map[int]string{4242: "123456"})
+
+	start, err := processStartToken(4242)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if start != "123456" {
+		test.Errorf("processStartToken(): `%s', expected `123456'", start)
+	}
+	if _, err = processStartToken(4243); err == nil {
+		test.Error("processStartToken(): Error was not detected on missing process")
+	}
+}
+
+func TestNoProc(test *testing.T) {
+	dmn := newTestContext(test, "serve")
+	saved := procRoot
+	procRoot = filepath.Join(filepath.Dir(dmn.PidFileName), "proc")
+	defer func() { procRoot = saved }()
+
+	if _, err := GetExecPath(os.Getpid()); err != ErrNoProc {
+		test.Fatal("GetExecPath(): expected ErrNoProc, got", err)
+	}
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	if !IsProcessRunning(child.Pid) {
+		test.Fatal("IsProcessRunning(): alive process is not running")
+	}
+	if state, err := dmn.State(); state != StateRunning {
+		test.Fatal("State():", state, err)
+	}
+	if err := dmn.StopE(); err != nil {
+		test.Fatal(err)
+	}
+	if IsProcessRunning(child.Pid, dmn.PidFileName) {
+		test.Fatal("IsProcessRunning(): stopped process is running")
+	}
+}
+
+func TestSearchByExe(test *testing.T) {
+	start := func() (*Context, *os.Process) {
+		dmn := newTestContext(test, "serve")
+		// only the daemons of the test have the mark
+		dmn.MarkName = "_GO_DAEMON_SEARCH"
+		dmn.Env = append(dmn.Env, MARK_NAME+"="+MARK_VALUE)
+		child := startHelper(test, dmn)
+		test.Cleanup(func() {
+			child.Kill()
+			child.Wait()
+		})
+		return dmn, child
+	}
+	dmn, child := start()
+	p, err := dmn.SearchByExe()
+	if err != nil || p.Pid != child.Pid {
+		test.Fatal("SearchByExe():", p, err)
+	}
+
+	// the oldest daemon is found
+	time.Sleep(20 * time.Millisecond)
+	_, other := start()
+	if p, err = dmn.SearchByExe(); err != nil || p.Pid != child.Pid {
+		test.Fatal("SearchByExe() of two daemons:", p, err)
+	}
+
+	child.Kill()
+	child.Wait()
+	if p, err = dmn.SearchByExe(); err != nil || p.Pid != other.Pid {
+		test.Fatal("SearchByExe() after exit:", p, err)
+	}
+	other.Kill()
+	other.Wait()
+	if p, err = dmn.SearchByExe(); err != ErrNotRunning {
+		test.Fatal("SearchByExe(): expected ErrNotRunning, got", p, err)
+	}
+}
+
+func TestLockOwner(test *testing.T) {
+	lock, err := CreatePidFile(filename, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	if pid, err := lock.Owner(); pid != os.Getpid() || err != nil {
+		test.Fatal("Owner() of own lock:", pid, err)
+	}
+	lock.Remove()
+
+	dmn := newTestContext(test, "serve")
+	child := startHelper(test, dmn)
+	defer child.Wait()
+	defer dmn.StopE()
+	other, err := OpenLockFile(dmn.PidFileName, fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer other.Close()
+	// the lock is inherited from parent, the content does not matter
+	if err = other.writePidInfo(1, nil); err != nil {
+		test.Fatal(err)
+	}
+	if pid, err := other.Owner(); pid != child.Pid || err != nil {
+		test.Fatal("Owner() of daemon lock:", pid, err)
+	}
+	if err = other.writePidInfo(child.Pid, nil); err != nil {
+		test.Fatal(err)
+	}
+
+	unlocked, err := OpenLockFile(filepath.Join(filepath.Dir(dmn.PidFileName), "unlocked"), fileperm)
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer unlocked.Close()
+	if _, err = unlocked.Owner(); err != ErrNotLocked {
+		test.Fatal("Owner() of unlocked file:", err)
+	}
+}
+
+func TestFindDaemons(test *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		test.Skip(err)
+	}
+	data, err := ioutil.ReadFile(sleep)
+	if err != nil {
+		test.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		test.Fatal(err)
+	}
+	app := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(app, data, 0755); err != nil {
+		test.Fatal(err)
+	}
+
+	var cmds []*exec.Cmd
+	for i := 0; i < 2; i++ {
+		cmd := exec.Command(app, "10")
+		if err = cmd.Start(); err != nil {
+			test.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer cmd.Process.Kill()
+		cmds = append(cmds, cmd)
+	}
+	find := func(exe string) map[int]bool {
+		daemons, err := FindDaemons(exe)
+		if err != nil {
+			test.Fatal(err)
+		}
+		pids := make(map[int]bool)
+		for _, p := range daemons {
+			pids[p.Pid] = true
+		}
+		return pids
+	}
+	for _, exe := range []string{app, "app"} {
+		if pids := find(exe); len(pids) != 2 || !pids[cmds[0].Process.Pid] || !pids[cmds[1].Process.Pid] {
+			test.Errorf("FindDaemons(%q): %v", exe, pids)
+		}
+	}
+
+	cmds[0].Process.Kill()
+	cmds[0].Wait()
+	if pids := find(app); len(pids) != 1 || !pids[cmds[1].Process.Pid] {
+		test.Error("FindDaemons() after exit:", pids)
+	}
+	exe, err := GetExecPath(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	if pids := find(exe); pids[os.Getpid()] {
+		test.Error("FindDaemons(): the current process is found")
+	}
+}
+
+func TestProcessStartTimeTicks(test *testing.T) {
+	fakeProc(test, "/usr/bin/tool", map[int]string{4242: "123456"})
+	if err := ioutil.WriteFile(filepath.Join(procRoot, "uptime"), []byte("2000.00 100.00\n"), 0644); err != nil {
+		test.Fatal(err)
+	}
+
+	start, err := processStartTime(4242)
+	if err != nil {
+		test.Fatal(err)
+	}
+	// started 1234.56s after boot, which was 2000s ago
+	if alive := time.Since(start); alive < 765*time.Second || alive > 766*time.Second {
+		test.Errorf("processStartTime(): process is alive for %v, expected 765.44s", alive)
+	}
+}
+
+func TestIsProcessRunningPidReuse(test *testing.T) {
+	exe, err := GetExecPath(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	fakeProc(test, exe, map[int]string{os.Getpid(): "1000", 4242: "2000"})
+
+	name := filepath.Join(procRoot, "test.pid")
+	write := func(content string) {
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			test.Fatal(err)
+		}
+	}
+
+	write("4242\nstart=2000\n")
+	if !IsProcessRunning(4242, name) {
+		test.Error("IsProcessRunning(): process with recorded start time is not running")
+	}
+
+	// the pid is reused by another copy of the program
+	write("4242\nstart=1500\n")
+	if IsProcessRunning(4242, name) {
+		test.Error("IsProcessRunning(): process with reused pid is running")
+	}
+
+	// pid file of an older version has no start time
+	write("4242\n")
+	if !IsProcessRunning(4242, name) {
+		test.Error("IsProcessRunning(): process of legacy pid file is not running")
+	}
+}
+
+func TestIsProcessRunningReplacedExec(test *testing.T) {
+	sleep, err := exec.LookPath("sleep")
+	if err != nil {
+		test.Skip(err)
+	}
+	data, err := ioutil.ReadFile(sleep)
+	if err != nil {
+		test.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		test.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		test.Fatal(err)
+	}
+
+	app := filepath.Join(dir, "app")
+	if err = ioutil.WriteFile(app, data, 0755); err != nil {
+		test.Fatal(err)
+	}
+	cmd := exec.Command(app, "10")
+	if err = cmd.Start(); err != nil {
+		test.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	// the binary is replaced, like on upgrade
+	if err = ioutil.WriteFile(app+".new", data, 0755); err != nil {
+		test.Fatal(err)
+	}
+	if err = os.Rename(app+".new", app); err != nil {
+		test.Fatal(err)
+	}
+
+	if !IsProcessRunningAs(pid, app) {
+		test.Error("IsProcessRunningAs(): process of replaced binary is not running")
+	}
+	if !IsProcessRunningAs(pid, "app") {
+		test.Error("IsProcessRunningAs(): process is not matched by base name")
+	}
+	if IsProcessRunningAs(pid, "other") {
+		test.Error("IsProcessRunningAs(): process is matched by another name")
+	}
+	if IsProcessRunning(pid) {
+		test.Error("IsProcessRunning(): process of another binary is running")
+	}
+}
+
+func TestIsProcessRunningDeletedExec(test *testing.T) {
+	fakeProc(test, "/opt/app/bin/app (deleted)", map[int]string{4242: "2000"})
+
+	if !IsProcessRunningAs(4242, "/opt/app/bin/app") {
+		test.Error("IsProcessRunningAs(): process of deleted binary is not running")
+	}
+	if !IsProcessRunningAs(4242, "app") {
+		test.Error("IsProcessRunningAs(): process of deleted binary is not matched by base name")
+	}
+	if IsProcessRunningAs(4242, "/opt/app/bin/app2") {
+		test.Error("IsProcessRunningAs(): process is matched by another path")
+	}
+}
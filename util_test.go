@@ -0,0 +1,75 @@
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGetExecPath(test *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		test.Fatal(err)
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		test.Fatal(err)
+	}
+
+	path, err := GetExecPath(os.Getpid())
+	if err != nil {
+		test.Fatal(err)
+	}
+	// e.g. short names of Windows are expanded
+	if path, err = filepath.EvalSymlinks(path); err != nil {
+		test.Fatal(err)
+	}
+	if path != exe {
+		test.Errorf("GetExecPath(): `%s', expected `%s'", path, exe)
+	}
+}
+
+func TestMatchExec(test *testing.T) {
+	matches := []struct {
+		exe_path, exe string
+		match         bool
+	}{
+		{"/opt/app/bin/app", "/opt/app/bin/app", true},
+		{"/opt/app/bin/app", "/opt/app/bin/../bin/app", true},
+		{"/opt/app/bin/app", "app", true},
+		{"/opt/app/bin/app", "/opt/app/app", false},
+		{"/opt/app/bin/app", "bin/app", false},
+		{"/opt/app/bin/app", "ap", false},
+	}
+	for _, m := range matches {
+		if match := matchExec(m.exe_path, m.exe); match != m.match {
+			test.Errorf("matchExec(`%s', `%s'): %v", m.exe_path, m.exe, match)
+		}
+	}
+}
+
+func TestIsPidFileFresh(test *testing.T) {
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		modTime time.Duration // since start
+		window  time.Duration
+		fresh   bool
+	}{
+		{0, time.Minute, true},
+		{time.Second, time.Minute, true},
+		{59*time.Second + 999*time.Millisecond, time.Minute, true},
+		{time.Minute, time.Minute, false},
+		{time.Minute + time.Millisecond, time.Minute, false},
+		{-59 * time.Second, time.Minute, true},
+		{-time.Minute, time.Minute, false},
+		{time.Hour, time.Minute, false},
+		{30 * time.Second, 10 * time.Second, false},
+		{30 * time.Second, 2 * time.Minute, true},
+		{0, 0, false},
+	}
+	for _, c := range cases {
+		if fresh := isPidFileFresh(start.Add(c.modTime), start, c.window); fresh != c.fresh {
+			test.Errorf("isPidFileFresh(%v after start, window %v): %v", c.modTime, c.window, fresh)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package daemon
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	modkernel32                    = syscall.NewLazyDLL("kernel32.dll")
+	procQueryFullProcessImageNameW = modkernel32.NewProc("QueryFullProcessImageNameW")
+)
+
+const (
+	_PROCESS_QUERY_LIMITED_INFORMATION = 0x1000
+	_STILL_ACTIVE                      = 259
+)
+
+// listPids is not supported.
+func listPids() ([]int, error) {
+	return nil, ErrNotSupported
+}
+
+// lockOwner is not supported.
+func lockOwner(fi os.FileInfo) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// processEnv is not supported.
+func processEnv(pid int) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// checkWritable does nothing, permissions are checked on creating files.
+func checkWritable(dir string) error {
+	return nil
+}
+
+// checkPidFileOwner does nothing, the owner of files is not checked.
+func checkPidFileOwner(name string, owners ...int) error {
+	return nil
+}
+
+// GetExecPath returns the path of executable file of the process.
+func GetExecPath(pid int) (string, error) {
+	h, err := syscall.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return "", err
+	}
+	defer syscall.CloseHandle(h)
+
+	buf := make([]uint16, syscall.MAX_LONG_PATH)
+	size := uint32(len(buf))
+	r, _, err := procQueryFullProcessImageNameW.Call(uintptr(h), 0,
+		uintptr(unsafe.Pointer(&buf[0])), uintptr(unsafe.Pointer(&size)))
+	if r == 0 {
+		return "", err
+	}
+	return syscall.UTF16ToString(buf[:size]), nil
+}
+
+// processStartTime returns the creation time of the process.
+func processStartTime(pid int) (time.Time, error) {
+	h, err := syscall.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer syscall.CloseHandle(h)
+
+	var creation, exit, kernel, user syscall.Filetime
+	if err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, creation.Nanoseconds()), nil
+}
+
+// processStartToken returns the creation time of the process, which
+// identifies the process together with pid.
+func processStartToken(pid int) (string, error) {
+	start, err := processStartTime(pid)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(start.UnixNano(), 10), nil
+}
+
+// reapChild releases the exited process, Windows has no zombie processes.
+func reapChild(p *os.Process, deadline time.Time) {
+	p.Release()
+}
+
+// processExists reports whether the process with given pid is alive.
+func processExists(pid int) bool {
+	h, err := syscall.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	return syscall.GetExitCodeProcess(h, &code) == nil && code == _STILL_ACTIVE
+}
+
+// IsProcessRunning reports whether the process with given pid is alive and
+// runs the same executable as the current process, see IsProcessRunningAs.
+func IsProcessRunning(pid int, pidfiles ...string) bool {
+	return IsProcessRunningAs(pid, "", pidfiles...)
+}
+
+// IsProcessRunningAs reports whether the process with given pid is alive and
+// runs the executable exe, given either by path or by base name. If exe
+// is empty, the executable of the current process is used. If the
+// executables differ, the process creation time is compared with
+// modification time of pid file, see PidFileWindow.
+func IsProcessRunningAs(pid int, exe string, pidfiles ...string) bool {
+	h, err := syscall.OpenProcess(_PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err = syscall.GetExitCodeProcess(h, &code); err != nil || code != _STILL_ACTIVE {
+		return false
+	}
+
+	if len(exe) == 0 {
+		my_path, err := GetExecPath(os.Getpid())
+		if err != nil {
+			return false
+		}
+		exe = my_path
+	}
+	exe_path, err := GetExecPath(pid)
+	if err != nil {
+		return false
+	}
+	if len(pidfiles) > 0 {
+		// start time recorded in pid file identifies the process exactly
+		if match, ok := matchStart(pid, pidfiles[0]); ok {
+			return match
+		}
+	}
+	if matchExec(exe_path, exe) {
+		return true
+	}
+	if len(pidfiles) > 0 {
+		pidfile_s, err := os.Stat(pidfiles[0])
+		if err != nil {
+			return false
+		}
+		var creation, exit, kernel, user syscall.Filetime
+		if err = syscall.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+			return false
+		}
+		start := time.Unix(0, creation.Nanoseconds())
+		if isPidFileFresh(pidfile_s.ModTime(), start, PidFileWindow) {
+			return true
+		}
+	}
+	return false
+}